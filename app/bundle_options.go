@@ -0,0 +1,144 @@
+package app
+
+import (
+	"strings"
+
+	"myapp/fhir"
+)
+
+// ReferenceStrategy is how resources in a Bundle refer to each other
+type ReferenceStrategy int
+
+const (
+	// URNReferences refers to entries by their urn:uuid fullUrl, which resolves
+	// inside a document Bundle without a server
+	URNReferences ReferenceStrategy = iota
+	// RelativeReferences writes Patient/<id> style references, resolved against
+	// the BaseURL of the fullUrls
+	RelativeReferences
+	// AbsoluteReferences writes <BaseURL>/Patient/<id> style references
+	AbsoluteReferences
+)
+
+// IPSSection identifies a Composition section by its LOINC code
+type IPSSection string
+
+const (
+	MedicationSection   IPSSection = "10160-0"
+	AllergySection      IPSSection = "48765-2"
+	ProblemSection      IPSSection = "11450-4"
+	VitalSignsSection   IPSSection = "61150-9"
+	ResultsSection      IPSSection = "30954-2"
+	ImmunizationSection IPSSection = "11369-6"
+)
+
+// EmptySectionPolicy is what happens to a section when the record has nothing for it
+type EmptySectionPolicy int
+
+const (
+	// OmitEmptySection leaves the section out of the Composition
+	OmitEmptySection EmptySectionPolicy = iota
+	// NilKnownSection keeps the section with the nilknown emptyReason and
+	// narrative such as "No known allergies". Only use it for senders whose
+	// messages always include the information when there is any.
+	NilKnownSection
+	// UnavailableSection keeps the section with the unavailable emptyReason, as
+	// HL7 messages may simply leave the information out
+	UnavailableSection
+)
+
+// BundleOptions controls the parts of the generated FHIR Bundle that depend on
+// where it is being sent rather than on the HL7 record itself
+type BundleOptions struct {
+	// IdentifierSystems maps a PID-3 assigning authority, e.g. "NHS", to the
+	// system URI used for its Patient.identifier entries. A system given in the
+	// message itself is used for authorities that are not listed.
+	IdentifierSystems map[string]string
+
+	// PlaceholderAuthor is shown as the Composition author, without a reference,
+	// when the record names no practitioner at all, and as the Provenance author
+	// when the message names no sending application or facility
+	PlaceholderAuthor string
+
+	// ReferenceStrategy applies to every reference in the Bundle. With a BaseURL
+	// the fullUrls are <BaseURL>/<type>/<id> for relative and absolute references
+	// alike, so both resolve. Relative and absolute references need a BaseURL and
+	// fall back to urn:uuid without one, as nothing else would resolve them.
+	ReferenceStrategy ReferenceStrategy
+	BaseURL           string
+
+	// EmptySections says what to do with each section that has no entries.
+	// Sections that are not listed are left out. A nil map uses the defaults,
+	// which keep the sections IPS requires (medications, allergies and problems)
+	// as unavailable - a message without AL1 segments is no evidence that the
+	// patient has no known allergies.
+	EmptySections map[IPSSection]EmptySectionPolicy
+}
+
+const defaultPlaceholderAuthor = "Unknown author"
+
+// DefaultBundleOptions gives the settings used by GenerateIPSBundle and
+// GenerateIPSBundles. Each call returns new maps, so a caller can change its
+// copy without affecting conversions running elsewhere.
+func DefaultBundleOptions() BundleOptions {
+	return BundleOptions{
+		IdentifierSystems: map[string]string{
+			"NHS": "https://fhir.nhs.uk/Id/nhs-number",
+		},
+		PlaceholderAuthor: defaultPlaceholderAuthor,
+		EmptySections:     defaultEmptySections(),
+	}
+}
+
+func defaultEmptySections() map[IPSSection]EmptySectionPolicy {
+	return map[IPSSection]EmptySectionPolicy{
+		MedicationSection: UnavailableSection,
+		AllergySection:    UnavailableSection,
+		ProblemSection:    UnavailableSection,
+	}
+}
+
+// identifierSystem finds the system URI for an identifier
+func (o BundleOptions) identifierSystem(assigningAuthority string, system string) string {
+	if uri, ok := o.IdentifierSystems[assigningAuthority]; ok {
+		return uri
+	}
+	return system
+}
+
+// placeholderAuthor names the author when nobody else can be named
+func (o BundleOptions) placeholderAuthor() string {
+	if o.PlaceholderAuthor == "" {
+		return defaultPlaceholderAuthor
+	}
+	return o.PlaceholderAuthor
+}
+
+// emptySection finds the policy for a section without entries
+func (o BundleOptions) emptySection(section IPSSection) EmptySectionPolicy {
+	if o.EmptySections == nil {
+		return defaultEmptySections()[section]
+	}
+	return o.EmptySections[section]
+}
+
+// fullURL gives the Bundle.entry.fullUrl of a resource
+func (o BundleOptions) fullURL(resourceType string, id string) string {
+	if o.BaseURL != "" && o.ReferenceStrategy != URNReferences {
+		return strings.TrimSuffix(o.BaseURL, "/") + "/" + resourceType + "/" + id
+	}
+	return "urn:uuid:" + id
+}
+
+// reference gives the Reference.reference pointing at a resource in the Bundle
+func (o BundleOptions) reference(resourceType string, id string) string {
+	if o.ReferenceStrategy == RelativeReferences && o.BaseURL != "" {
+		return resourceType + "/" + id
+	}
+	return o.fullURL(resourceType, id)
+}
+
+// referenceTo refers to a resource in the same Bundle
+func (o BundleOptions) referenceTo(resource fhir.Resource) fhir.Reference {
+	return fhir.Reference{Reference: o.reference(resource.ResourceType(), resource.ResourceID())}
+}
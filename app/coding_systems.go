@@ -0,0 +1,73 @@
+package app
+
+import (
+	"strings"
+
+	"myapp/fhir"
+	. "myapp/models"
+)
+
+// HL7 coding system names (HL7 table 0396) and their FHIR canonical URIs
+var codingSystemURIs = map[string]string{
+	"SCT":     "http://snomed.info/sct",
+	"SNOMED":  "http://snomed.info/sct",
+	"LN":      "http://loinc.org",
+	"LOINC":   "http://loinc.org",
+	"I10":     "http://hl7.org/fhir/sid/icd-10",
+	"ICD10":   "http://hl7.org/fhir/sid/icd-10",
+	"I10C":    "http://hl7.org/fhir/sid/icd-10-cm",
+	"ICD10CM": "http://hl7.org/fhir/sid/icd-10-cm",
+	"I9C":     "http://hl7.org/fhir/sid/icd-9-cm",
+	"RXNORM":  "http://www.nlm.nih.gov/research/umls/rxnorm",
+	"CVX":     "http://hl7.org/fhir/sid/cvx",
+	"NDC":     "http://hl7.org/fhir/sid/ndc",
+	"ATC":     "http://www.whocc.no/atc",
+	"WC":      "http://www.whocc.no/atc",
+	"UCUM":    "http://unitsofmeasure.org",
+	"DMD":     "https://dmd.nhs.uk",
+	"ISO639":  "urn:ietf:bcp:47",
+}
+
+// fhirSystem turns an HL7 coding system name into its FHIR URI. HL7 tables such
+// as HL70063 map onto the v2 code systems, values that already look like a URI
+// are passed through, and local or unknown systems give an empty string.
+func fhirSystem(system string) string {
+	if uri, ok := codingSystemURIs[strings.ToUpper(system)]; ok {
+		return uri
+	}
+	if strings.HasPrefix(system, "HL7") && len(system) == 7 {
+		return "http://terminology.hl7.org/CodeSystem/v2-" + system[3:]
+	}
+	if strings.Contains(system, ":") {
+		return system
+	}
+	return ""
+}
+
+// fhirCoding builds a FHIR Coding, leaving out anything the sender did not supply
+func fhirCoding(coding Coding) fhir.Coding {
+	fhirCoding := fhir.Coding{Code: coding.Code, Display: coding.Display}
+	if system := fhirSystem(coding.System); system != "" {
+		fhirCoding.System = system
+		fhirCoding.Version = coding.Version
+	}
+	return fhirCoding
+}
+
+// codeableConcept builds a CodeableConcept from every coding of a CWE field. Free
+// text without codes, including records converted before codes were kept, is
+// left in Text alone rather than being passed off as a Coding.
+func codeableConcept(codings []Coding, text string) fhir.CodeableConcept {
+	concept := fhir.CodeableConcept{Text: text}
+	for _, coding := range codings {
+		concept.Coding = append(concept.Coding, fhirCoding(coding))
+	}
+	return concept
+}
+
+// statusConcept builds the CodeableConcept for a status code from a FHIR code system
+func statusConcept(system string, code string) *fhir.CodeableConcept {
+	return &fhir.CodeableConcept{
+		Coding: []fhir.Coding{{System: system, Code: code}},
+	}
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	. "myapp/models"
+)
+
+// AL1-4 and IAM-4 severity codes (HL7 table 0128) as FHIR reaction severities
+var reactionSeverities = map[string]string{"SV": "severe", "MO": "moderate", "MI": "mild"}
+
+// The table 0128 codes that also say something about the risk of future
+// reactions, as FHIR criticalities. A mild or moderate past reaction does not
+// make the risk low.
+var allergyCriticalities = map[string]string{"SV": "high", "U": "unable-to-assess"}
+
+// allergenType is the FHIR category and type for an allergen type code
+type allergenType struct {
+	category string
+	kind     string
+}
+
+// AL1-2 and IAM-2 allergen type codes (HL7 table 0127). DI, FI and EI are
+// intolerance codes used by several senders alongside the standard allergy codes.
+var allergenTypes = map[string]allergenType{
+	"DA": {"medication", "allergy"},
+	"DI": {"medication", "intolerance"},
+	"FA": {"food", "allergy"},
+	"FI": {"food", "intolerance"},
+	"EA": {"environment", "allergy"},
+	"EI": {"environment", "intolerance"},
+	"AA": {"environment", "allergy"},
+	"PA": {"environment", "allergy"},
+	"LA": {"environment", "allergy"},
+	"MA": {"", "allergy"},
+	"MC": {"", "intolerance"},
+}
+
+// IAM-9 sensitivity to causative agent codes (HL7 table 0436) that decide the type
+var sensitivityTypes = map[string]string{
+	"AL": "allergy",
+	"IN": "intolerance",
+}
+
+// IAM-17 allergy clinical status codes (HL7 table 0438) and their FHIR verification status
+var allergyVerificationStatuses = map[string]string{
+	"C": "confirmed",
+	"I": "confirmed",
+	"U": "unconfirmed",
+	"P": "unconfirmed",
+	"S": "unconfirmed",
+	"D": "unconfirmed",
+	"E": "entered-in-error",
+}
+
+// allergy handles AL1, taking the category and type from the AL1-2 allergen type.
+// AL1 has no status, so like DG1 the allergy is taken to be active.
+func (p *hl7Parser) allergy(seg Segment) {
+	if !p.required(seg, 3) {
+		return
+	}
+
+	kind := allergenTypes[seg.Component(2, 1)]
+	allergy := Allergy{
+		Name:           codedName(seg.first(3)),
+		Codes:          parseCodings(seg.first(3)),
+		Criticality:    allergyCriticalities[seg.Component(4, 1)],
+		Severity:       reactionSeverities[seg.Component(4, 1)],
+		Date:           p.date(seg, 6),
+		Type:           kind.kind,
+		Category:       kind.category,
+		Reactions:      reactions(seg, 5),
+		ClinicalStatus: "active",
+	}
+	p.data.Allergies = append(p.data.Allergies, allergy)
+}
+
+// reactions reads the repetitions of a CWE reaction field such as AL1-5. Older
+// senders put free text in AL1-5, which is kept as the name only rather than
+// being taken for a code.
+func reactions(seg Segment, field int) []Reaction {
+	var reactions []Reaction
+	for _, rep := range seg.Repetitions(field) {
+		reaction := Reaction{Name: codedName(rep), Codes: parseCodings(rep)}
+		if reaction.Name == "" {
+			continue
+		}
+		if !strings.Contains(rep.Value, string(rep.Delimiters.Component)) {
+			reaction.Name = rep.Text()
+			reaction.Codes = nil
+		}
+		reactions = append(reactions, reaction)
+	}
+	return reactions
+}
+
+// allergyDetail handles IAM, the detailed replacement for AL1. The IAM-6 action
+// code adds, updates or deletes the allergy with the same IAM-7 identifier.
+func (p *hl7Parser) allergyDetail(seg Segment) {
+	if !p.required(seg, 3) {
+		return
+	}
+
+	allergy := Allergy{
+		Name:        codedName(seg.first(3)),
+		Codes:       parseCodings(seg.first(3)),
+		Criticality: allergyCriticalities[seg.Component(4, 1)],
+		Severity:    reactionSeverities[seg.Component(4, 1)],
+		Date:        p.date(seg, 11),
+		ID:          seg.Component(7, 1),
+		Reactions:   reactions(seg, 5),
+	}
+
+	kind := allergenTypes[seg.Component(2, 1)]
+	allergy.Category = kind.category
+	allergy.Type = kind.kind
+	if sensitivity, ok := sensitivityTypes[seg.Component(9, 1)]; ok {
+		allergy.Type = sensitivity
+	}
+
+	status := seg.Component(17, 1)
+	allergy.VerificationStatus = allergyVerificationStatuses[status]
+	switch status {
+	case "I":
+		allergy.ClinicalStatus = "inactive"
+	case "E":
+		// FHIR does not allow a clinical status on an entered-in-error allergy
+	default:
+		allergy.ClinicalStatus = "active"
+	}
+
+	existing := -1
+	if allergy.ID != "" {
+		for i, other := range p.data.Allergies {
+			if other.ID == allergy.ID {
+				existing = i
+				break
+			}
+		}
+	}
+
+	switch action := seg.Component(6, 1); action {
+	case "D":
+		if existing >= 0 {
+			p.data.Allergies = append(p.data.Allergies[:existing], p.data.Allergies[existing+1:]...)
+		}
+	case "", "A", "U", "X":
+		if existing >= 0 {
+			p.data.Allergies[existing] = allergy
+		} else {
+			p.data.Allergies = append(p.data.Allergies, allergy)
+		}
+	default:
+		p.addError(seg, 6, fmt.Sprintf("unknown allergy action code %q", action))
+	}
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	. "myapp/models"
+)
+
+func TestAllergyDetail(t *testing.T) {
+	// iam builds an IAM segment with the given action, ID, allergen, severity and IAM-17 status
+	iam := func(action, id, allergen, severity, status string) string {
+		return "IAM|1|DA|" + allergen + "|" + severity + "|Rash|" + action + "|" + id + strings.Repeat("|", 10) + status
+	}
+	penicillin := "70618^Penicillin^RXNORM"
+	aspirin := "1191^Aspirin^RXNORM"
+
+	tests := []struct {
+		name     string
+		segments []string
+		want     []Allergy
+		wantErrs int
+	}{
+		{
+			name:     "add",
+			segments: []string{iam("A", "1", penicillin, "SV", "C"), iam("A", "2", aspirin, "MI", "C")},
+			want: []Allergy{
+				{Name: "Penicillin", ID: "1", Criticality: "high", Severity: "severe", Type: "allergy", Category: "medication", ClinicalStatus: "active", VerificationStatus: "confirmed"},
+				{Name: "Aspirin", ID: "2", Severity: "mild", Type: "allergy", Category: "medication", ClinicalStatus: "active", VerificationStatus: "confirmed"},
+			},
+		},
+		{
+			name:     "update replaces the allergy with the same IAM-7",
+			segments: []string{iam("A", "1", penicillin, "MI", "U"), iam("A", "2", aspirin, "", ""), iam("U", "1", penicillin, "SV", "C")},
+			want: []Allergy{
+				{Name: "Penicillin", ID: "1", Criticality: "high", Severity: "severe", Type: "allergy", Category: "medication", ClinicalStatus: "active", VerificationStatus: "confirmed"},
+				{Name: "Aspirin", ID: "2", Type: "allergy", Category: "medication", ClinicalStatus: "active"},
+			},
+		},
+		{
+			name:     "update of an unknown allergy adds it",
+			segments: []string{iam("U", "1", penicillin, "MO", "")},
+			want: []Allergy{
+				{Name: "Penicillin", ID: "1", Severity: "moderate", Type: "allergy", Category: "medication", ClinicalStatus: "active"},
+			},
+		},
+		{
+			name:     "delete removes the allergy with the same IAM-7",
+			segments: []string{iam("A", "1", penicillin, "", ""), iam("A", "2", aspirin, "", ""), iam("D", "1", penicillin, "", "")},
+			want: []Allergy{
+				{Name: "Aspirin", ID: "2", Type: "allergy", Category: "medication", ClinicalStatus: "active"},
+			},
+		},
+		{
+			name:     "delete of an unknown allergy does nothing",
+			segments: []string{iam("A", "1", penicillin, "", ""), iam("D", "2", aspirin, "", "")},
+			want: []Allergy{
+				{Name: "Penicillin", ID: "1", Type: "allergy", Category: "medication", ClinicalStatus: "active"},
+			},
+		},
+		{
+			name:     "allergies without an ID are always added",
+			segments: []string{iam("", "", penicillin, "", ""), iam("X", "", penicillin, "", "")},
+			want: []Allergy{
+				{Name: "Penicillin", Type: "allergy", Category: "medication", ClinicalStatus: "active"},
+				{Name: "Penicillin", Type: "allergy", Category: "medication", ClinicalStatus: "active"},
+			},
+		},
+		{
+			name:     "unknown action",
+			segments: []string{iam("Z", "1", penicillin, "", "")},
+			wantErrs: 1,
+		},
+		{
+			name:     "unknown severity is unable to assess",
+			segments: []string{iam("A", "1", penicillin, "U", "")},
+			want: []Allergy{
+				{Name: "Penicillin", ID: "1", Criticality: "unable-to-assess", Type: "allergy", Category: "medication", ClinicalStatus: "active"},
+			},
+		},
+		{
+			name:     "inactive",
+			segments: []string{iam("A", "1", penicillin, "", "I")},
+			want: []Allergy{
+				{Name: "Penicillin", ID: "1", Type: "allergy", Category: "medication", ClinicalStatus: "inactive", VerificationStatus: "confirmed"},
+			},
+		},
+		{
+			name:     "entered in error has no clinical status",
+			segments: []string{iam("A", "1", penicillin, "", "E")},
+			want: []Allergy{
+				{Name: "Penicillin", ID: "1", Type: "allergy", Category: "medication", VerificationStatus: "entered-in-error"},
+			},
+		},
+		{
+			name:     "IAM-9 sensitivity decides the type",
+			segments: []string{"IAM|1|DA|" + penicillin + "||||1||IN"},
+			want: []Allergy{
+				{Name: "Penicillin", ID: "1", Type: "intolerance", Category: "medication", ClinicalStatus: "active"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := "MSH|^~\\&|EHR|HOSP|||20240501103000+0100||ADT^A60|M1|P|2.5\r" +
+				"PID|1||123^^^HOSP^MR||Smith^Jane\r" +
+				strings.Join(tt.segments, "\r") + "\r"
+
+			records, parseErrs, err := parseHL7Records(message)
+			if err != nil {
+				t.Fatalf("parseHL7Records() error = %v", err)
+			}
+			if len(parseErrs) != tt.wantErrs {
+				t.Errorf("parseHL7Records() parse errors = %v, want %d", parseErrs, tt.wantErrs)
+			}
+
+			var got []Allergy
+			for _, allergy := range records[0].Allergies {
+				// The codes and reactions are covered by the golden tests
+				allergy.Codes = nil
+				allergy.Reactions = nil
+				got = append(got, allergy)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("allergies = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseHL7Batch splits HL7 input into its individual messages. A plain message
+// comes back as a single entry, while FHS/BHS batch files are unwrapped and the
+// counts declared in BTS-1 and FTS-1 are checked against what was found.
+// A message that cannot be tokenized is reported and skipped, and the rest of
+// the batch is still returned.
+func ParseHL7Batch(hl7Input string) ([]Message, ParseErrors, error) {
+	lines := splitSegments(hl7Input)
+
+	var messages []Message
+	var errs ParseErrors
+	delimiters := DefaultDelimiters
+
+	start := -1        // first line of the message currently being collected
+	batchMessages := 0 // messages seen since the last BHS
+	batches := 0       // BHS segments seen
+	openBatch := 0     // line of a BHS still waiting for its BTS
+
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		message, err := parseMessageLines(lines[start:end], start+1)
+		first := start
+		start = -1
+		// The message was still sent, so it counts towards BTS-1 either way
+		batchMessages++
+		if err != nil {
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				parseErr = &ParseError{Segment: "MSH", Line: first + 1, Reason: err.Error()}
+			}
+			errs = append(errs, parseErr)
+			return
+		}
+		messages = append(messages, message)
+	}
+
+	for i, line := range lines {
+		name := line
+		if len(name) > 3 {
+			name = name[:3]
+		}
+
+		switch name {
+		case "MSH":
+			flush(i)
+			start = i
+		case "FHS", "BHS", "BTS", "FTS":
+			flush(i)
+			if isHeaderSegment(name) {
+				// A header too short to declare its delimiters keeps the ones already in use
+				if d, err := parseDelimiters(line); err != nil {
+					errs = append(errs, &ParseError{Segment: name, Line: i + 1, Field: 1, Reason: err.Error()})
+				} else {
+					delimiters = d
+				}
+			}
+			seg := delimiters.tokenize(line)
+			seg.Line = i + 1
+
+			switch name {
+			case "BHS":
+				batches++
+				batchMessages = 0
+				openBatch = seg.Line
+			case "BTS":
+				if err := checkDeclaredCount(seg, batchMessages, "messages"); err != nil {
+					errs = append(errs, err)
+				}
+				openBatch = 0
+			case "FTS":
+				if err := checkDeclaredCount(seg, batches, "batches"); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		default:
+			// Segments before any MSH still form a message so its missing header gets reported
+			if start < 0 && line != "" {
+				start = i
+			}
+		}
+	}
+	flush(len(lines))
+
+	if openBatch > 0 {
+		errs = append(errs, &ParseError{Segment: "BHS", Line: openBatch, Reason: "batch has no closing BTS segment"})
+	}
+	return messages, errs, nil
+}
+
+// checkDeclaredCount compares the count in field 1 of a BTS or FTS trailer with
+// the number actually found. Senders may leave the count empty.
+func checkDeclaredCount(seg Segment, found int, what string) *ParseError {
+	declared := strings.TrimSpace(seg.Field(1))
+	if declared == "" {
+		return nil
+	}
+	count, err := strconv.Atoi(declared)
+	if err != nil {
+		return &ParseError{Segment: seg.Name, Line: seg.Line, Field: 1, Reason: fmt.Sprintf("invalid count %q", declared)}
+	}
+	if count != found {
+		return &ParseError{Segment: seg.Name, Line: seg.Line, Field: 1, Reason: fmt.Sprintf("declares %d %s but %d were found", count, what, found)}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHL7Batch(t *testing.T) {
+	msh := func(id string) string {
+		return "MSH|^~\\&|LAB|HOSP|||20240501103000+0100||ORU^R01|" + id + "|P|2.5"
+	}
+	lines := func(segments ...string) string {
+		return strings.Join(segments, "\r") + "\r"
+	}
+
+	tests := []struct {
+		name      string
+		input     string
+		wantIDs   []string
+		wantLines []int
+		wantErrs  []string
+	}{
+		{
+			name:      "plain message",
+			input:     lines(msh("M1"), "PID|1||123"),
+			wantIDs:   []string{"M1"},
+			wantLines: []int{1},
+		},
+		{
+			name:      "MLLP framing and CRLF terminators",
+			input:     "\x0b" + msh("M1") + "\r\nPID|1||123\r\n\x1c\r",
+			wantIDs:   []string{"M1"},
+			wantLines: []int{1},
+		},
+		{
+			name:      "batch file with matching counts",
+			input:     lines("FHS|^~\\&|LAB", "BHS|^~\\&|LAB", msh("M1"), "PID|1||123", msh("M2"), "PID|1||456", "BTS|2", "FTS|1"),
+			wantIDs:   []string{"M1", "M2"},
+			wantLines: []int{3, 5},
+		},
+		{
+			name:      "empty counts are not checked",
+			input:     lines("BHS|^~\\&|LAB", msh("M1"), "BTS", "FTS|"),
+			wantIDs:   []string{"M1"},
+			wantLines: []int{2},
+		},
+		{
+			name:      "each batch counts its own messages",
+			input:     lines("FHS|^~\\&|LAB", "BHS|^~\\&|LAB", msh("M1"), "BTS|1", "BHS|^~\\&|LAB", msh("M2"), msh("M3"), "BTS|2", "FTS|2"),
+			wantIDs:   []string{"M1", "M2", "M3"},
+			wantLines: []int{3, 6, 7},
+		},
+		{
+			name:      "BTS count mismatch",
+			input:     lines("BHS|^~\\&|LAB", msh("M1"), "BTS|3"),
+			wantIDs:   []string{"M1"},
+			wantLines: []int{2},
+			wantErrs:  []string{"line 3: BTS-1: declares 3 messages but 1 were found"},
+		},
+		{
+			name:      "FTS count mismatch",
+			input:     lines("FHS|^~\\&|LAB", "BHS|^~\\&|LAB", msh("M1"), "BTS|1", "FTS|2"),
+			wantIDs:   []string{"M1"},
+			wantLines: []int{3},
+			wantErrs:  []string{"line 5: FTS-1: declares 2 batches but 1 were found"},
+		},
+		{
+			name:      "invalid count",
+			input:     lines("BHS|^~\\&|LAB", msh("M1"), "BTS|one"),
+			wantIDs:   []string{"M1"},
+			wantLines: []int{2},
+			wantErrs:  []string{`line 3: BTS-1: invalid count "one"`},
+		},
+		{
+			name:      "batch without a BTS",
+			input:     lines("BHS|^~\\&|LAB", msh("M1"), msh("M2")),
+			wantIDs:   []string{"M1", "M2"},
+			wantLines: []int{2, 3},
+			wantErrs:  []string{"line 1: BHS: batch has no closing BTS segment"},
+		},
+		{
+			name:      "malformed MSH is skipped but still counted",
+			input:     lines("BHS|^~\\&|LAB", msh("M1"), "MSH", "PID|1||456", msh("M3"), "BTS|3"),
+			wantIDs:   []string{"M1", "M3"},
+			wantLines: []int{2, 5},
+			wantErrs:  []string{"line 3: MSH-1: segment too short to contain a field separator"},
+		},
+		{
+			name:      "header too short for its delimiters",
+			input:     lines("BHS", msh("M1"), "BTS|1"),
+			wantIDs:   []string{"M1"},
+			wantLines: []int{2},
+			wantErrs:  []string{"line 1: BHS-1: segment too short to contain a field separator"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, parseErrs, err := ParseHL7Batch(tt.input)
+			if err != nil {
+				t.Fatalf("ParseHL7Batch() error = %v", err)
+			}
+
+			var ids []string
+			var firstLines []int
+			for _, message := range messages {
+				ids = append(ids, message.Segments[0].Field(10))
+				firstLines = append(firstLines, message.Segments[0].Line)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("ParseHL7Batch() control IDs = %q, want %q", ids, tt.wantIDs)
+			}
+			for i, line := range firstLines {
+				if i < len(tt.wantLines) && line != tt.wantLines[i] {
+					t.Errorf("message %d starts on line %d, want %d", i+1, line, tt.wantLines[i])
+				}
+			}
+
+			var errs []string
+			for _, parseErr := range parseErrs {
+				errs = append(errs, parseErr.Error())
+			}
+			if strings.Join(errs, "\n") != strings.Join(tt.wantErrs, "\n") {
+				t.Errorf("ParseHL7Batch() parse errors = %q, want %q", errs, tt.wantErrs)
+			}
+		})
+	}
+}
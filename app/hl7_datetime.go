@@ -0,0 +1,115 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseHL7DateOrDateTime converts an HL7 DTM/TS value, from a bare year up to
+// YYYYMMDDHHMMSS.SSSS+ZZZZ, to a FHIR date or dateTime with the same precision.
+// Years, months and dates come out as "2024", "2024-01" and "2024-01-15". Times
+// keep their offset; those sent without one are taken to be in zone (an HL7
+// offset such as "+0100"). When that is empty too the offset is unknown, so the
+// value is cut down to its date and returned along with an error.
+func parseHL7DateOrDateTime(input string, zone string) (string, error) {
+	invalid := fmt.Errorf("invalid HL7 date format: %s", input)
+
+	value := strings.TrimSpace(input)
+	offset := ""
+	if i := strings.IndexAny(value, "+-"); i >= 0 {
+		value, offset = value[:i], value[i:]
+		if !validOffset(offset) {
+			return "", invalid
+		}
+	}
+	fraction := ""
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		value, fraction = value[:i], value[i+1:]
+		if len(value) != 14 || len(fraction) == 0 || len(fraction) > 4 || !digits(fraction) {
+			return "", invalid
+		}
+	}
+	if !digits(value) {
+		return "", invalid
+	}
+
+	// Missing parts default to the start of the period so the values can be validated
+	parts := []int{0, 1, 1, 0, 0, 0}
+	switch len(value) {
+	case 4, 6, 8, 10, 12, 14:
+	default:
+		return "", invalid
+	}
+	parts[0], _ = strconv.Atoi(value[:4])
+	for i := 4; i < len(value); i += 2 {
+		parts[i/2-1], _ = strconv.Atoi(value[i : i+2])
+	}
+	t := time.Date(parts[0], time.Month(parts[1]), parts[2], parts[3], parts[4], parts[5], 0, time.UTC)
+	if t.Month() != time.Month(parts[1]) || t.Day() != parts[2] || t.Hour() != parts[3] ||
+		t.Minute() != parts[4] || t.Second() != parts[5] {
+		return "", invalid
+	}
+
+	switch len(value) {
+	case 4:
+		return t.Format("2006"), nil
+	case 6:
+		return t.Format("2006-01"), nil
+	case 8:
+		return t.Format("2006-01-02"), nil
+	}
+
+	// FHIR dateTime needs seconds and an offset whenever a time is given
+	dateTime := t.Format("2006-01-02T15:04:05")
+	if fraction != "" {
+		dateTime += "." + fraction
+	}
+	if offset == "" {
+		offset = zone
+	}
+	if offset == "" {
+		return t.Format("2006-01-02"), fmt.Errorf("HL7 time %s has no UTC offset, only the date is kept", input)
+	}
+	if offset == "+0000" || offset == "-0000" {
+		return dateTime + "Z", nil
+	}
+	return dateTime + offset[:3] + ":" + offset[3:], nil
+}
+
+// hl7Offset returns the UTC offset of an HL7 timestamp, or "" when it has none
+func hl7Offset(value string) string {
+	if i := strings.IndexAny(value, "+-"); i >= 0 && validOffset(value[i:]) {
+		return value[i:]
+	}
+	return ""
+}
+
+// fhirDate cuts a FHIR dateTime down to its date, for elements such as birthDate
+// that cannot hold a time
+func fhirDate(dateTime string) string {
+	if len(dateTime) > 10 {
+		return dateTime[:10]
+	}
+	return dateTime
+}
+
+// validOffset checks an HL7 +/-HHMM offset
+func validOffset(offset string) bool {
+	if len(offset) != 5 || !digits(offset[1:]) {
+		return false
+	}
+	hours, _ := strconv.Atoi(offset[1:3])
+	minutes, _ := strconv.Atoi(offset[3:])
+	return hours <= 14 && minutes < 60
+}
+
+func digits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,48 @@
+package app
+
+import "testing"
+
+func TestParseHL7DateOrDateTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		zone    string
+		want    string
+		wantErr bool
+	}{
+		{name: "year", input: "2024", want: "2024"},
+		{name: "month", input: "202405", want: "2024-05"},
+		{name: "date", input: "20240501", want: "2024-05-01"},
+		{name: "date ignores the zone", input: "20240501", zone: "+0100", want: "2024-05-01"},
+		{name: "hour gets minutes and seconds", input: "2024050110", zone: "+0100", want: "2024-05-01T10:00:00+01:00"},
+		{name: "minute gets seconds", input: "202405011030", zone: "+0100", want: "2024-05-01T10:30:00+01:00"},
+		{name: "second", input: "20240501103015", zone: "-0500", want: "2024-05-01T10:30:15-05:00"},
+		{name: "fraction", input: "20240501103015.1234", zone: "+0100", want: "2024-05-01T10:30:15.1234+01:00"},
+		{name: "own offset wins over the zone", input: "20240501103015+0200", zone: "+0100", want: "2024-05-01T10:30:15+02:00"},
+		{name: "UTC", input: "20240501103015+0000", want: "2024-05-01T10:30:15Z"},
+		{name: "time without any offset keeps the date", input: "20240501103015", want: "2024-05-01", wantErr: true},
+		{name: "surrounding spaces", input: " 20240501 ", want: "2024-05-01"},
+		{name: "odd length", input: "2024051", wantErr: true},
+		{name: "month out of range", input: "202413", wantErr: true},
+		{name: "day out of range", input: "20240230", wantErr: true},
+		{name: "hour out of range", input: "2024050124", zone: "+0100", wantErr: true},
+		{name: "date out of range with a time", input: "20240230103015", zone: "+0100", wantErr: true},
+		{name: "fraction without seconds", input: "202405011030.5", zone: "+0100", wantErr: true},
+		{name: "fraction too long", input: "20240501103015.12345", zone: "+0100", wantErr: true},
+		{name: "offset out of range", input: "20240501103015+1500", wantErr: true},
+		{name: "short offset", input: "20240501103015+01", wantErr: true},
+		{name: "not a number", input: "May 2024", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHL7DateOrDateTime(tt.input, tt.zone)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHL7DateOrDateTime(%q, %q) error = %v, wantErr %v", tt.input, tt.zone, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseHL7DateOrDateTime(%q, %q) = %q, want %q", tt.input, tt.zone, got, tt.want)
+			}
+		})
+	}
+}
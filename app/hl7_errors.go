@@ -0,0 +1,33 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseError describes a problem found in a single segment of an HL7 message
+type ParseError struct {
+	Segment string
+	Line    int
+	Field   int
+	Reason  string
+}
+
+func (e *ParseError) Error() string {
+	if e.Field > 0 {
+		return fmt.Sprintf("line %d: %s-%d: %s", e.Line, e.Segment, e.Field, e.Reason)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Segment, e.Reason)
+}
+
+// ParseErrors collects the non-fatal problems found while converting a message.
+// The converted output is still returned alongside them.
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d HL7 parse error(s): %s", len(e), strings.Join(messages, "; "))
+}
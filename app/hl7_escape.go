@@ -0,0 +1,146 @@
+package app
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DecodeEscapes replaces HL7 escape sequences with the characters they stand for.
+// Formatting commands such as \.br\ become line breaks, with \.sp<n>\ and \.sk<n>\
+// repeating at most maxEscapeCount times, highlighting and character set
+// switches are dropped, and unterminated sequences are left as-is.
+// Malformed sequences are reported as ParseErrors when the segment is parsed.
+func (d Delimiters) DecodeEscapes(value string) string {
+	decoded, _ := d.decodeEscapes(value)
+	return decoded
+}
+
+// decodeEscapes is DecodeEscapes, also returning the first malformed sequence found
+func (d Delimiters) decodeEscapes(value string) (string, error) {
+	esc := d.Escape
+	if strings.IndexByte(value, esc) < 0 {
+		return value, nil
+	}
+
+	var problem error
+
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != esc {
+			sb.WriteByte(value[i])
+			continue
+		}
+
+		end := strings.IndexByte(value[i+1:], esc)
+		if end < 0 {
+			// No closing escape character, keep the rest verbatim
+			problem = firstError(problem, fmt.Errorf("unterminated escape sequence %q", value[i:]))
+			sb.WriteString(value[i:])
+			break
+		}
+		sequence := value[i+1 : i+1+end]
+		i += end + 1
+
+		switch {
+		case sequence == "F":
+			sb.WriteByte(d.Field)
+		case sequence == "S":
+			sb.WriteByte(d.Component)
+		case sequence == "T":
+			sb.WriteByte(d.Subcomponent)
+		case sequence == "R":
+			sb.WriteByte(d.Repetition)
+		case sequence == "E":
+			sb.WriteByte(d.Escape)
+		case sequence == ".br":
+			sb.WriteByte('\n')
+		case strings.HasPrefix(sequence, ".sp"), strings.HasPrefix(sequence, ".sk"):
+			count, ok := escapeCount(sequence[3:])
+			if !ok {
+				problem = firstError(problem, fmt.Errorf("escape sequence %q repeats more than %d times", d.escapeSequence(sequence), maxEscapeCount))
+			}
+			if sequence[2] == 'p' {
+				sb.WriteString(strings.Repeat("\n", count))
+			} else {
+				sb.WriteString(strings.Repeat(" ", count))
+			}
+		case strings.HasPrefix(sequence, "X"):
+			decoded, err := hex.DecodeString(sequence[1:])
+			if err != nil {
+				problem = firstError(problem, fmt.Errorf("invalid hexadecimal escape sequence %q", d.escapeSequence(sequence)))
+				continue
+			}
+			sb.Write(decoded)
+		case sequence == "H", sequence == "N", strings.HasPrefix(sequence, "."),
+			strings.HasPrefix(sequence, "C"), strings.HasPrefix(sequence, "M"),
+			strings.HasPrefix(sequence, "Z"):
+			// Highlighting, other formatting and character set changes have no plain text equivalent
+		default:
+			sb.WriteByte(esc)
+			sb.WriteString(sequence)
+			sb.WriteByte(esc)
+		}
+	}
+	return sb.String(), problem
+}
+
+// EncodeEscapes is the inverse of DecodeEscapes, escaping delimiters and line
+// breaks so the value can be written back into an HL7 field
+func (d Delimiters) EncodeEscapes(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case d.Escape:
+			sb.WriteString(d.escapeSequence("E"))
+		case d.Field:
+			sb.WriteString(d.escapeSequence("F"))
+		case d.Component:
+			sb.WriteString(d.escapeSequence("S"))
+		case d.Subcomponent:
+			sb.WriteString(d.escapeSequence("T"))
+		case d.Repetition:
+			sb.WriteString(d.escapeSequence("R"))
+		case '\r':
+			if i+1 < len(value) && value[i+1] == '\n' {
+				i++
+			}
+			sb.WriteString(d.escapeSequence(".br"))
+		case '\n':
+			sb.WriteString(d.escapeSequence(".br"))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func (d Delimiters) escapeSequence(sequence string) string {
+	return string(d.Escape) + sequence + string(d.Escape)
+}
+
+func firstError(first error, err error) error {
+	if first != nil {
+		return first
+	}
+	return err
+}
+
+// maxEscapeCount caps the repeat count of \.sp<n>\ and \.sk<n>\, so a single
+// value cannot ask for any amount of memory
+const maxEscapeCount = 99
+
+// escapeCount reads the optional repeat count of \.sp<n>\ and \.sk<n>\, defaulting
+// to one. Counts over maxEscapeCount are cut down to it and reported as not ok.
+func escapeCount(arg string) (int, bool) {
+	arg = strings.TrimSpace(strings.TrimPrefix(arg, "+"))
+	if !digits(arg) {
+		return 1, true
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil || n > maxEscapeCount {
+		return maxEscapeCount, false
+	}
+	return max(n, 1), true
+}
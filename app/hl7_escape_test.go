@@ -0,0 +1,96 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeEscapes(t *testing.T) {
+	custom := Delimiters{Field: '#', Component: '*', Repetition: '$', Escape: '@', Subcomponent: '%'}
+
+	tests := []struct {
+		name       string
+		delimiters Delimiters
+		value      string
+		want       string
+		wantErr    bool
+	}{
+		{"no escapes", DefaultDelimiters, "plain text", "plain text", false},
+		{"delimiters", DefaultDelimiters, `\F\\S\\T\\R\\E\`, `|^&~\`, false},
+		{"custom delimiters", custom, `@F@@S@@T@@R@@E@`, `#*%$@`, false},
+		{"line breaks", DefaultDelimiters, `one\.br\two\.sp2\three`, "one\ntwo\n\nthree", false},
+		{"skipped spaces", DefaultDelimiters, `a\.sk3\b`, "a   b", false},
+		{"largest repeat count", DefaultDelimiters, `\.sk99\`, strings.Repeat(" ", maxEscapeCount), false},
+		{"repeat count over the limit", DefaultDelimiters, `a\.sk100\b`, "a" + strings.Repeat(" ", maxEscapeCount) + "b", true},
+		{"repeat count overflowing an int", DefaultDelimiters, `\.sp999999999999999999\`, strings.Repeat("\n", maxEscapeCount), true},
+		{"hexadecimal", DefaultDelimiters, `\X4142\`, "AB", false},
+		{"highlighting is dropped", DefaultDelimiters, `\H\bold\N\`, "bold", false},
+		{"unknown sequences are kept", DefaultDelimiters, `\Q\`, `\Q\`, false},
+		{"unterminated sequence is kept", DefaultDelimiters, `a\F`, `a\F`, true},
+		{"odd hexadecimal digits", DefaultDelimiters, `a\X414\b`, "ab", true},
+		{"invalid hexadecimal digits", DefaultDelimiters, `\XZZ\`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.delimiters.decodeEscapes(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeEscapes(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("decodeEscapes(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+			if public := tt.delimiters.DecodeEscapes(tt.value); public != got {
+				t.Errorf("DecodeEscapes(%q) = %q, want %q", tt.value, public, got)
+			}
+		})
+	}
+}
+
+func TestEncodeEscapesRoundTrip(t *testing.T) {
+	custom := Delimiters{Field: '#', Component: '*', Repetition: '$', Escape: '@', Subcomponent: '%'}
+
+	tests := []struct {
+		name       string
+		delimiters Delimiters
+		value      string
+		want       string
+	}{
+		{"plain text", DefaultDelimiters, "plain text", "plain text"},
+		{"field separator", DefaultDelimiters, "a|b", `a\F\b`},
+		{"component separator", DefaultDelimiters, "a^b", `a\S\b`},
+		{"subcomponent separator", DefaultDelimiters, "a&b", `a\T\b`},
+		{"repetition separator", DefaultDelimiters, "a~b", `a\R\b`},
+		{"escape character", DefaultDelimiters, `a\b`, `a\E\b`},
+		{"all delimiters", DefaultDelimiters, `|^&~\`, `\F\\S\\T\\R\\E\`},
+		{"line break", DefaultDelimiters, "one\ntwo", `one\.br\two`},
+		{"custom delimiters", custom, "#*%$@", `@F@@S@@T@@R@@E@`},
+		{"default delimiters are text under custom ones", custom, `|^&~\`, `|^&~\`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := tt.delimiters.EncodeEscapes(tt.value)
+			if encoded != tt.want {
+				t.Errorf("EncodeEscapes(%q) = %q, want %q", tt.value, encoded, tt.want)
+			}
+			decoded, err := tt.delimiters.decodeEscapes(encoded)
+			if err != nil || decoded != tt.value {
+				t.Errorf("decodeEscapes(%q) = %q, %v, want %q", encoded, decoded, err, tt.value)
+			}
+		})
+	}
+}
+
+func TestEscapeErrorsAreParseErrors(t *testing.T) {
+	message := "MSH|^~\\&|LAB|HOSP|||20240501103000+0100||ORU^R01|M1|P|2.5\r" +
+		"PID|1||123^^^HOSP^MR||Smith\\X4\\^Jane\r"
+
+	_, parseErrs, err := parseHL7Records(message)
+	if err != nil {
+		t.Fatalf("parseHL7Records() error = %v", err)
+	}
+	if len(parseErrs) != 1 || parseErrs[0].Segment != "PID" || parseErrs[0].Field != 5 {
+		t.Errorf("parseHL7Records() parse errors = %v, want one for PID-5", parseErrs)
+	}
+}
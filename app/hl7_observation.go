@@ -0,0 +1,197 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	. "myapp/models"
+)
+
+// observationValue fills in the typed value of an observation according to the
+// OBX-2 value type. Types without a typed equivalent stay as the Value text.
+func (p *hl7Parser) observationValue(seg Segment, observation *Observation) {
+	observation.ValueType = seg.Field(2)
+	value := seg.first(5)
+	if value.Value == "" {
+		return
+	}
+
+	switch observation.ValueType {
+	case "NM":
+		number, err := parseNumber(value.Text())
+		if err != nil {
+			p.addError(seg, 5, err.Error())
+			return
+		}
+		quantity := observationUnits(seg)
+		quantity.Value = number
+		observation.Quantity = &quantity
+	case "SN":
+		if err := structuredNumeric(value, observationUnits(seg), observation); err != nil {
+			p.addError(seg, 5, err.Error())
+		}
+	case "CE", "CWE", "CNE", "CF":
+		coding := parseCoding(value)
+		observation.CodedValue = &coding
+	case "DT", "TS", "DTM":
+		observation.DateTime = p.date(seg, 5)
+	}
+}
+
+// OBX-11 observation result status codes (HL7 table 0085) and their FHIR Observation.status equivalents
+var observationStatuses = map[string]string{
+	"C": "corrected",
+	"A": "amended",
+	"D": "entered-in-error",
+	"W": "entered-in-error",
+	"F": "final",
+	"U": "final",
+	"I": "registered",
+	"O": "registered",
+	"P": "preliminary",
+	"R": "preliminary",
+	"S": "preliminary",
+	"N": "cancelled",
+	"X": "cancelled",
+}
+
+// observationFlags reads the reference range, abnormal flags and result status
+func (p *hl7Parser) observationFlags(seg Segment, observation *Observation) {
+	if text := seg.Text(7); text != "" {
+		observation.ReferenceRange = referenceRange(text, observationUnits(seg))
+	}
+	for _, rep := range seg.Repetitions(8) {
+		if flag := rep.Component(1); flag != "" {
+			observation.AbnormalFlags = append(observation.AbnormalFlags, flag)
+		}
+	}
+
+	status := seg.Field(11)
+	observation.Status = observationStatuses[status]
+	if status != "" && observation.Status == "" {
+		p.addError(seg, 11, fmt.Sprintf("unknown result status %q", status))
+	}
+}
+
+// referenceRange reads the bounds from ranges such as "3.5-5.0", ">10" or "<=5".
+// Anything else, e.g. "negative", is kept as text only.
+func referenceRange(text string, units Quantity) *ReferenceRange {
+	rangeText := strings.TrimSpace(text)
+	reference := &ReferenceRange{Text: text}
+	bound := func(number string) *Quantity {
+		value, err := parseNumber(number)
+		if err != nil {
+			return nil
+		}
+		quantity := units
+		quantity.Value = value
+		return &quantity
+	}
+
+	switch {
+	case strings.HasPrefix(rangeText, ">"):
+		reference.Low = bound(strings.TrimLeft(rangeText, ">="))
+	case strings.HasPrefix(rangeText, "<"):
+		reference.High = bound(strings.TrimLeft(rangeText, "<="))
+	case len(rangeText) > 1:
+		// Look for the dash after the first character so a negative low bound such as "-2-2" still splits
+		if i := strings.Index(rangeText[1:], "-") + 1; i > 0 {
+			low, high := bound(rangeText[:i]), bound(rangeText[i+1:])
+			if low != nil && high != nil {
+				reference.Low, reference.High = low, high
+			}
+		}
+	}
+	return reference
+}
+
+// observationUnits reads the OBX-6 units into an otherwise empty quantity
+func observationUnits(seg Segment) Quantity {
+	units := seg.first(6)
+	quantity := Quantity{
+		Code:   units.Component(1),
+		Unit:   units.Component(2),
+		System: units.Component(3),
+	}
+	if quantity.Unit == "" {
+		quantity.Unit = quantity.Code
+	}
+	return quantity
+}
+
+// structuredNumeric maps an SN value (comparator^num1^separator^num2) onto a
+// quantity with comparator, a range ("10^-^20") or a ratio ("1^:^128")
+func structuredNumeric(value Repetition, units Quantity, observation *Observation) error {
+	comparator := value.Component(1)
+	separator := value.Component(3)
+
+	first, err := parseNumber(value.Component(2))
+	if err != nil {
+		return err
+	}
+
+	if value.Component(4) == "" {
+		quantity := units
+		quantity.Value = first
+		switch comparator {
+		case "<", "<=", ">", ">=":
+			quantity.Comparator = comparator
+		case "", "=":
+		default:
+			return fmt.Errorf("unsupported SN comparator %q", comparator)
+		}
+		if separator != "" {
+			// Categorical results such as "2^+" have no numeric equivalent
+			return nil
+		}
+		observation.Quantity = &quantity
+		return nil
+	}
+
+	second, err := parseNumber(value.Component(4))
+	if err != nil {
+		return err
+	}
+
+	switch separator {
+	case "-":
+		low, high := units, units
+		low.Value = first
+		high.Value = second
+		observation.Range = &Range{Low: &low, High: &high}
+	case ":", "/":
+		observation.Ratio = &Ratio{
+			Numerator:   Quantity{Value: first},
+			Denominator: Quantity{Value: second},
+		}
+	default:
+		return fmt.Errorf("unsupported SN separator %q", separator)
+	}
+	return nil
+}
+
+// An NM value - optional sign, digits and decimal point. Exponents are not
+// part of NM but some senders use them.
+var numberPattern = regexp.MustCompile(`^([+-]?)(\d*)(\.\d*)?([eE][+-]?\d+)?$`)
+
+// parseNumber checks an NM value and writes it as a JSON number with the same
+// digits, so "7.10" keeps the precision it was reported with
+func parseNumber(text string) (json.Number, error) {
+	match := numberPattern.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil || match[2]+strings.TrimPrefix(match[3], ".") == "" {
+		return "", fmt.Errorf("invalid number %q", text)
+	}
+	sign, integer, fraction, exponent := match[1], strings.TrimLeft(match[2], "0"), match[3], match[4]
+	if sign == "+" {
+		sign = ""
+	}
+	if integer == "" {
+		integer = "0"
+	}
+	if fraction == "." {
+		fraction = ""
+	}
+	return json.Number(sign + integer + fraction + exponent), nil
+}
@@ -0,0 +1,185 @@
+package app
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	. "myapp/models"
+)
+
+func TestObservationValue(t *testing.T) {
+	mmol := Quantity{Unit: "mmol/L", Code: "mmol/L", System: "UCUM"}
+	quantity := func(units Quantity, value, comparator string) *Quantity {
+		units.Value = json.Number(value)
+		units.Comparator = comparator
+		return &units
+	}
+
+	tests := []struct {
+		name      string
+		valueType string
+		value     string
+		units     string
+		want      Observation
+		wantErr   bool
+	}{
+		{
+			name:      "NM keeps its digits",
+			valueType: "NM",
+			value:     "7.10",
+			units:     "mmol/L^mmol/L^UCUM",
+			want:      Observation{Quantity: quantity(mmol, "7.10", "")},
+		},
+		{
+			name:      "NM drops a plus sign and leading zeros",
+			valueType: "NM",
+			value:     "+007.5",
+			want:      Observation{Quantity: &Quantity{Value: "7.5"}},
+		},
+		{
+			name:      "NM that is not a number",
+			valueType: "NM",
+			value:     "high",
+			wantErr:   true,
+		},
+		{
+			name:      "SN comparator",
+			valueType: "SN",
+			value:     "<^5",
+			units:     "mmol/L^mmol/L^UCUM",
+			want:      Observation{Quantity: quantity(mmol, "5", "<")},
+		},
+		{
+			name:      "SN equals is no comparator",
+			valueType: "SN",
+			value:     "=^5",
+			units:     "mmol/L^mmol/L^UCUM",
+			want:      Observation{Quantity: quantity(mmol, "5", "")},
+		},
+		{
+			name:      "SN range",
+			valueType: "SN",
+			value:     "^10^-^20",
+			units:     "mmol/L^mmol/L^UCUM",
+			want:      Observation{Range: &Range{Low: quantity(mmol, "10", ""), High: quantity(mmol, "20", "")}},
+		},
+		{
+			name:      "SN ratio",
+			valueType: "SN",
+			value:     "^1^:^128",
+			want:      Observation{Ratio: &Ratio{Numerator: Quantity{Value: "1"}, Denominator: Quantity{Value: "128"}}},
+		},
+		{
+			name:      "SN categorical result has no number",
+			valueType: "SN",
+			value:     "^2^+",
+		},
+		{
+			name:      "SN unsupported comparator",
+			valueType: "SN",
+			value:     "<>^5",
+			wantErr:   true,
+		},
+		{
+			name:      "SN unsupported separator",
+			valueType: "SN",
+			value:     "^1^*^2",
+			wantErr:   true,
+		},
+		{
+			name:      "CWE",
+			valueType: "CWE",
+			value:     "260385009^Negative^SCT",
+			want:      Observation{CodedValue: &Coding{Code: "260385009", Display: "Negative", System: "SCT"}},
+		},
+		{
+			name:      "CE is read the same way",
+			valueType: "CE",
+			value:     "POS^Positive^L",
+			want:      Observation{CodedValue: &Coding{Code: "POS", Display: "Positive", System: "L"}},
+		},
+		{
+			name:      "TS",
+			valueType: "TS",
+			value:     "202405011030",
+			want:      Observation{DateTime: "2024-05-01T10:30:00+01:00"},
+		},
+		{
+			name:      "DT",
+			valueType: "DT",
+			value:     "20240501",
+			want:      Observation{DateTime: "2024-05-01"},
+		},
+		{
+			name:      "invalid TS",
+			valueType: "TS",
+			value:     "20241301",
+			wantErr:   true,
+		},
+		{
+			name:      "text has no typed value",
+			valueType: "ST",
+			value:     "see note",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := "MSH|^~\\&|LAB|HOSP|||20240501103000+0100||ORU^R01|M1|P|2.5\r" +
+				"PID|1||123^^^HOSP^MR||Smith^Jane\r" +
+				"OBX|1|" + tt.valueType + "|1234-5^Test^LN||" + tt.value + "|" + tt.units + "|||||F\r"
+
+			records, parseErrs, err := parseHL7Records(message)
+			if err != nil {
+				t.Fatalf("parseHL7Records() error = %v", err)
+			}
+			if (len(parseErrs) > 0) != tt.wantErr {
+				t.Errorf("parseHL7Records() parse errors = %v, wantErr %v", parseErrs, tt.wantErr)
+			}
+
+			observation := records[0].Observations[0]
+			got := Observation{
+				Quantity:   observation.Quantity,
+				Range:      observation.Range,
+				Ratio:      observation.Ratio,
+				CodedValue: observation.CodedValue,
+				DateTime:   observation.DateTime,
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("typed value = %+v, want %+v", got, tt.want)
+			}
+			if observation.ValueType != tt.valueType {
+				t.Errorf("ValueType = %q, want %q", observation.ValueType, tt.valueType)
+			}
+		})
+	}
+}
+
+func TestReferenceRange(t *testing.T) {
+	units := Quantity{Unit: "mmol/L"}
+	bound := func(value string) *Quantity {
+		return &Quantity{Value: json.Number(value), Unit: "mmol/L"}
+	}
+
+	tests := []struct {
+		name string
+		text string
+		want ReferenceRange
+	}{
+		{"low and high", "3.5-5.0", ReferenceRange{Low: bound("3.5"), High: bound("5.0"), Text: "3.5-5.0"}},
+		{"negative low bound", "-2-2", ReferenceRange{Low: bound("-2"), High: bound("2"), Text: "-2-2"}},
+		{"lower limit only", ">10", ReferenceRange{Low: bound("10"), Text: ">10"}},
+		{"upper limit only", "<=5", ReferenceRange{High: bound("5"), Text: "<=5"}},
+		{"text only", "negative", ReferenceRange{Text: "negative"}},
+		{"half a range is text only", "3.5-high", ReferenceRange{Text: "3.5-high"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := referenceRange(tt.text, units); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("referenceRange(%q) = %+v, want %+v", tt.text, *got, tt.want)
+			}
+		})
+	}
+}
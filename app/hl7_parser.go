@@ -1,141 +1,499 @@
 package app
 
 import (
-    "fmt"
 	"encoding/json"
-	"strings"
-	"time"
+	"fmt"
 	. "myapp/models"
+	"strings"
+
+	"github.com/google/uuid"
 )
 
+// HL7toMongoDb converts an HL7 message to MongoDB JSON. Batch files produce a
+// JSON array with one record per message. Problems with individual segments do
+// not stop the conversion - they are returned as ParseErrors together with the
+// JSON that could still be produced.
 func HL7toMongoDb(hl7Message string) (string, error) {
-	lines := strings.Split(hl7Message, "\n")
+	records, parseErrs, err := parseHL7Records(hl7Message)
+	if err != nil {
+		return "", err
+	}
+
+	var output interface{} = records
+	if len(records) == 1 {
+		output = records[0]
+	}
+	mongodbJSON, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return withParseErrors(string(mongodbJSON), parseErrs)
+}
+
+// HL7toMongoDbNDJSON converts an HL7 message or batch to newline-delimited
+// MongoDB JSON with one record per line, ready for mongoimport
+func HL7toMongoDbNDJSON(hl7Input string) (string, error) {
+	records, parseErrs, err := parseHL7Records(hl7Input)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return "", err
+		}
+		sb.Write(line)
+		sb.WriteByte('\n')
+	}
+	return withParseErrors(sb.String(), parseErrs)
+}
 
+// parseHL7Records converts every message in the input into its own record
+func parseHL7Records(hl7Input string) ([]HL7FHIRData, ParseErrors, error) {
+	messages, parseErrs, err := ParseHL7Batch(hl7Input)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(messages) == 0 && len(parseErrs) > 0 {
+		// Nothing could be converted, so the problems are the whole answer
+		return nil, nil, parseErrs
+	}
+	if len(messages) == 0 {
+		return nil, nil, fmt.Errorf("no HL7 segments found")
+	}
+
+	records := make([]HL7FHIRData, 0, len(messages))
+	for _, message := range messages {
+		record, recordErrs := parseHL7Record(message)
+		records = append(records, record)
+		parseErrs = append(parseErrs, recordErrs...)
+	}
+	return records, parseErrs, nil
+}
+
+func withParseErrors(output string, parseErrs ParseErrors) (string, error) {
+	if len(parseErrs) > 0 {
+		return output, parseErrs
+	}
+	return output, nil
+}
+
+// hl7Parser builds up a single record and the problems found along the way
+type hl7Parser struct {
+	data HL7FHIRData
+	errs ParseErrors
+
+	// MSH-9 message code, e.g. VXU or RDE
+	messageType string
+
+	// MSH-7 UTC offset, e.g. "+0100", used for times sent without one
+	zone string
+
+	// The ORC waiting for its OBR, the OBR that following OBX results belong to,
+	// and the RXO medication that an RXE in the same order group replaces
+	order      *orderContext
+	report     int
+	prescribed int
+}
+
+// orderContext holds the ORC fields that OBR may leave empty
+type orderContext struct {
+	placerOrderNumber string
+	fillerOrderNumber string
+	orderingProvider  string
+	transactionDate   string
+}
+
+func parseHL7Record(message Message) (HL7FHIRData, ParseErrors) {
 	// Define the data - note we only need to add the array elements as the single elements are already members
-	data := HL7FHIRData{
-        Medication:    []Medication{},
-        Allergies:     []Allergy{},
-        Conditions:    []Condition{},
-        Observations:  []Observation{},
-        Immunizations: []Immunization{},
-    }
-
-	for _, line := range lines {
-		segments := strings.Split(line, "|")
-		if len(segments) < 2 {
+	p := &hl7Parser{
+		data: HL7FHIRData{
+			Medication:    []Medication{},
+			Allergies:     []Allergy{},
+			Conditions:    []Condition{},
+			Observations:  []Observation{},
+			Immunizations: []Immunization{},
+
+			DiagnosticReports: []DiagnosticReport{},
+
+			// MSH-10 is only unique to the sender, so the package gets its own ID
+			PackageUUID: uuid.New().String(),
+		},
+		report:     -1,
+		prescribed: -1,
+	}
+
+	if len(message.Segments) == 0 || message.Segments[0].Name != "MSH" {
+		line := 1
+		if len(message.Segments) > 0 {
+			line = message.Segments[0].Line
+		}
+		p.errs = append(p.errs, &ParseError{Segment: "MSH", Line: line, Reason: "message does not start with an MSH segment"})
+	}
+	for _, seg := range message.Segments {
+		p.parseSegment(seg)
+	}
+	return p.data, p.errs
+}
+
+func (p *hl7Parser) parseSegment(seg Segment) {
+	if len(seg.Name) != 3 {
+		p.addError(seg, 0, fmt.Sprintf("%q is not a valid segment name", seg.Name))
+		return
+	}
+	if len(seg.Fields) < 2 {
+		return
+	}
+	for n := 1; n < len(seg.Fields); n++ {
+		// MSH-1 and MSH-2 are the delimiters themselves
+		if isHeaderSegment(seg.Name) && n <= 2 {
 			continue
 		}
+		if _, err := seg.Delimiters.decodeEscapes(seg.Fields[n]); err != nil {
+			p.addError(seg, n, err.Error())
+		}
+	}
 
-		switch segments[0] {
-		case "MSH":
-			if timestamp, err := parseHL7DateOrDateTime(segments[6]); err == nil {
-                data.TimeStamp = timestamp
-            }
-            data.PackageUUID = segments[9]
-		case "PID":
-			data.Patient = Patient{
-                Name:         parseSubfield(segments[5], 0),
-                Given:        parseSubfield(segments[5], 1),
-                Nation:       parseSubfield(segments[11], 3),
-                Organization: parseSubfield(segments[3], 3),
-            }
-            if dob, err := parseHL7DateOrDateTime(segments[7]); err == nil {
-                data.Patient.DOB = dob
-            }
-            switch strings.ToLower(segments[8]) {
-            case "m":
-                data.Patient.Gender = "male"
-            case "f":
-                data.Patient.Gender = "female"
-            default:
-                data.Patient.Gender = "other"
-            }
-		case "IVC":
-            data.Patient.Practitioner = segments[2]
-		case "RXA":
-            medicationName := segments[5]
-            date, _ := parseHL7DateOrDateTime(segments[3])
-            if len(segments) > 6 {
-                data.Medication = append(data.Medication, Medication{
-                    Name:   medicationName,
-                    Date:   date,
-                    Dosage: segments[6],
-                })
-            } else {
-                parts := strings.Split(medicationName, "^")
-                immunization := Immunization{
-                    Name:   parts[0],
-                    Date:   date,
-                }
-                if len(parts) > 1 {
-                    immunization.System = parts[1]
-                } else {
-                    immunization.System = "unknown"
-                }
-                data.Immunizations = append(data.Immunizations, immunization)
-            }
-		case "AL1":
-			if len(segments) > 6 {
-                date, _ := parseHL7DateOrDateTime(segments[6])
-                data.Allergies = append(data.Allergies, Allergy{
-                    Name:        parseSubfield(segments[3], 1),
-                    Criticality: map[string]string{"U": "low", "SV": "high", "MO": "moderate", "MI": "mild"}[segments[4]],
-                    Date:        date,
-                })
-            }
-		case "DG1":
-			if len(segments) > 5 {
-                date, _ := parseHL7DateOrDateTime(segments[5])
-                data.Conditions = append(data.Conditions, Condition{
-                    Name: parseSubfield(segments[3], 1),
-                    Date: date,
-                })
-            }
-		case "OBX":
-			if len(segments) > 12 {
-                date, _ := parseHL7DateOrDateTime(segments[12])
-                data.Observations = append(data.Observations, Observation{
-                    Name:  parseSubfield(segments[3], 1),
-                    Value: strings.TrimSpace(segments[5] + " " + segments[6]),
-                    Date:  date,
-                })
-            }
-		
-		default:
-			// Probably not needed but keep for now
-		}
-	}
-
-	mongodbJSON, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return "", err
+	switch seg.Name {
+	case "MSH":
+		p.required(seg, 9, 10)
+		p.zone = hl7Offset(seg.Component(7, 1))
+		p.data.TimeStamp = p.date(seg, 7)
+		p.messageType = seg.Component(9, 1)
+		p.data.Source = &MessageHeader{
+			MessageCode:          seg.Component(9, 1),
+			TriggerEvent:         seg.Component(9, 2),
+			MessageStructure:     seg.Component(9, 3),
+			ControlID:            seg.Field(10),
+			ProcessingID:         seg.Component(11, 1),
+			Version:              seg.Component(12, 1),
+			SendingApplication:   hierarchicDesignator(seg.first(3)),
+			SendingFacility:      hierarchicDesignator(seg.first(4)),
+			FacilitySystem:       universalIDSystem(seg.Component(4, 2), seg.Component(4, 3)),
+			ReceivingApplication: hierarchicDesignator(seg.first(5)),
+			ReceivingFacility:    hierarchicDesignator(seg.first(6)),
+		}
+	case "EVN":
+		if p.data.Source == nil {
+			p.addError(seg, 0, "EVN segment without an MSH header")
+			return
+		}
+		if p.data.Source.TriggerEvent == "" {
+			p.data.Source.TriggerEvent = seg.Field(1)
+		}
+		p.data.Source.RecordedDate = p.date(seg, 2)
+		p.data.Source.Operator = formatPersonName(seg.first(5))
+		p.data.Source.EventDate = p.date(seg, 6)
+	case "PID":
+		p.patient(seg)
+	case "NK1":
+		contact := Contact{
+			Name:         parsePersonName(seg.first(2)),
+			Relationship: parseCoding(seg.first(3)),
+			Role:         parseCoding(seg.first(7)),
+			Phone:        formatPhone(seg.first(5)),
+		}
+		if contact.Name.Family == "" && len(contact.Name.Given) == 0 {
+			p.addError(seg, 2, "contact has no name")
+			return
+		}
+		if rep := seg.first(4); rep.Value != "" {
+			address := parseAddress(rep)
+			contact.Address = &address
+		}
+		p.data.Patient.Contacts = append(p.data.Patient.Contacts, contact)
+	case "PV1":
+		p.required(seg, 2)
+		p.data.Encounter = &Encounter{
+			VisitNumber:     seg.Component(19, 1),
+			Class:           patientClasses[seg.Field(2)],
+			HospitalService: seg.Text(10),
+			Location:        formatLocation(seg.first(3)),
+			AttendingDoctor: formatPersonName(seg.first(7)),
+			AdmitDate:       p.date(seg, 44),
+			DischargeDate:   p.date(seg, 45),
+		}
+	case "PV2":
+		if p.data.Encounter == nil {
+			p.addError(seg, 0, "PV2 segment without a preceding PV1")
+			return
+		}
+		p.data.Encounter.AdmitReason = seg.Component(3, 2)
+		if p.data.Encounter.AdmitReason == "" {
+			p.data.Encounter.AdmitReason = seg.Component(3, 1)
+		}
+	case "PD1":
+		if provider := formatPersonName(seg.first(4)); provider != "" {
+			p.data.Patient.Practitioner = provider
+		}
+	case "IVC":
+		p.data.Patient.Practitioner = seg.Text(2)
+	case "RXA":
+		p.administration(seg)
+	case "RXO", "RXE":
+		p.prescription(seg)
+	case "AL1":
+		p.allergy(seg)
+	case "IAM":
+		p.allergyDetail(seg)
+	case "DG1":
+		p.diagnosis(seg)
+	case "PRB":
+		p.problem(seg)
+	case "ORC":
+		p.report = -1
+		p.prescribed = -1
+		p.order = &orderContext{
+			placerOrderNumber: seg.Component(2, 1),
+			fillerOrderNumber: seg.Component(3, 1),
+			orderingProvider:  formatPersonName(seg.first(12)),
+			transactionDate:   p.date(seg, 9),
+		}
+	case "OBR":
+		p.report = -1
+		if !p.required(seg, 4) {
+			return
+		}
+		report := DiagnosticReport{
+			Name:              codedName(seg.first(4)),
+			Codes:             parseCodings(seg.first(4)),
+			Category:          seg.Component(24, 1),
+			Status:            reportStatuses[seg.Field(25)],
+			Date:              p.date(seg, 7),
+			Issued:            p.instant(seg, 22),
+			OrderingProvider:  formatPersonName(seg.first(16)),
+			PlacerOrderNumber: seg.Component(2, 1),
+			FillerOrderNumber: seg.Component(3, 1),
+		}
+		if report.Date == "" {
+			// OBR-8 observation end date/time, for senders that leave the start out
+			report.Date = p.date(seg, 8)
+		}
+		if report.Status == "" {
+			report.Status = "unknown"
+		}
+		if p.order != nil {
+			if report.PlacerOrderNumber == "" {
+				report.PlacerOrderNumber = p.order.placerOrderNumber
+			}
+			if report.FillerOrderNumber == "" {
+				report.FillerOrderNumber = p.order.fillerOrderNumber
+			}
+			if report.OrderingProvider == "" {
+				report.OrderingProvider = p.order.orderingProvider
+			}
+			p.order = nil
+		}
+		// Repeated panels and ORC/OBR pairs can share order numbers, so the OBR position keeps the ID unique
+		report.ID = joinNonEmpty("-", report.PlacerOrderNumber, report.FillerOrderNumber, fmt.Sprintf("OBR%d", len(p.data.DiagnosticReports)+1))
+		p.data.DiagnosticReports = append(p.data.DiagnosticReports, report)
+		p.report = len(p.data.DiagnosticReports) - 1
+	case "OBX":
+		if !p.required(seg, 3) {
+			return
+		}
+		var values []string
+		for _, rep := range seg.Repetitions(5) {
+			values = append(values, rep.Text())
+		}
+		observation := Observation{
+			Name:  codedName(seg.first(3)),
+			Codes: parseCodings(seg.first(3)),
+			Value: joinNonEmpty(" ", strings.Join(values, ", "), observationUnits(seg).Unit),
+			// OBX-14 is the observation time, otherwise the OBR-7/OBR-8 time of its report
+			Date: p.date(seg, 14),
+		}
+		p.observationValue(seg, &observation)
+		p.observationFlags(seg, &observation)
+		if p.report >= 0 {
+			report := p.data.DiagnosticReports[p.report]
+			observation.ReportID = report.ID
+			if observation.Date == "" {
+				observation.Date = report.Date
+			}
+		}
+		p.data.Observations = append(p.data.Observations, observation)
+
+	default:
+		// Probably not needed but keep for now
 	}
-	return string(mongodbJSON), nil
 }
 
-// Helper functions for HL7 parsing
-func parseSubfield(field string, index int) string {
-	parts := strings.Split(field, "^")
-	if len(parts) > index {
-		return parts[index]
+// parseCoding reads the primary code, text, coding system and version of a CWE field
+func parseCoding(rep Repetition) Coding {
+	return Coding{
+		Code:    rep.Component(1),
+		Display: rep.Component(2),
+		System:  rep.Component(3),
+		Version: rep.Component(7),
+	}
+}
+
+// parseCodings reads the primary coding of a CWE field (components 1-3) and the
+// alternate coding (components 4-6) when the sender supplied one
+func parseCodings(rep Repetition) []Coding {
+	var codings []Coding
+	if primary := parseCoding(rep); primary.Code != "" || primary.Display != "" {
+		codings = append(codings, primary)
+	}
+	alternate := Coding{
+		Code:    rep.Component(4),
+		Display: rep.Component(5),
+		System:  rep.Component(6),
+		Version: rep.Component(8),
+	}
+	if alternate.Code != "" || alternate.Display != "" {
+		codings = append(codings, alternate)
+	}
+	return codings
+}
+
+// codedName picks the best text for a CWE field - the primary text, then the
+// alternate text, then the original text, and finally the code itself
+func codedName(rep Repetition) string {
+	for _, c := range []int{2, 5, 9, 1} {
+		if text := rep.Component(c); text != "" {
+			return text
+		}
 	}
 	return ""
 }
 
-func parseHL7DateOrDateTime(input string) (string, error) {
-	// Try to parse as long form (date and time)
-	t, err := time.Parse("20060102150405", input)
-	if err == nil {
-		return t.Format("2006-01-02T15:04:05.000Z"), nil
+// formatPhone returns the number from an XTN field, building it from the
+// country, area and local number components when the formatted number is empty
+func formatPhone(rep Repetition) string {
+	if number := rep.Component(1); number != "" {
+		return number
+	}
+	number := rep.Component(6) + rep.Component(7)
+	if number != "" && rep.Component(5) != "" {
+		number = "+" + rep.Component(5) + " " + number
+	}
+	return number
+}
+
+// OBR-25 result status codes (HL7 table 0123) and their FHIR DiagnosticReport.status equivalents
+var reportStatuses = map[string]string{
+	"O": "registered",
+	"I": "registered",
+	"S": "registered",
+	"A": "partial",
+	"R": "partial",
+	"P": "preliminary",
+	"C": "corrected",
+	"F": "final",
+	"X": "cancelled",
+}
+
+// PV1-2 patient class codes (HL7 table 0004) and their FHIR v3 ActCode equivalents
+var patientClasses = map[string]string{
+	"E": "EMER",
+	"I": "IMP",
+	"B": "IMP",
+	"O": "AMB",
+	"R": "AMB",
+	"P": "PRENC",
+}
+
+// formatPersonName turns an XCN provider into a display name such as "Dr John Smith"
+func formatPersonName(rep Repetition) string {
+	return joinNonEmpty(" ", rep.Component(6), rep.Component(3), rep.Subcomponent(2, 1))
+}
+
+// hierarchicDesignator names an application or facility from an HD field,
+// using the namespace ID and falling back to the universal ID
+func hierarchicDesignator(rep Repetition) string {
+	if namespace := rep.Component(1); namespace != "" {
+		return namespace
 	}
+	return rep.Component(2)
+}
+
+// formatLocation turns a PL location into a display such as "Ward 1, Room 2, Bed 3, General Hospital"
+func formatLocation(rep Repetition) string {
+	return joinNonEmpty(", ", rep.Component(1), rep.Component(2), rep.Component(3), rep.Subcomponent(4, 1))
+}
 
-	// If parsing as long form fails, try short form (date only)
-	t, err = time.Parse("20060102", input)
-	if err == nil {
-		return t.Format("2006-01-02T15:04:05.000Z"), nil
+func joinNonEmpty(sep string, values ...string) string {
+	var parts []string
+	for _, value := range values {
+		if value != "" {
+			parts = append(parts, value)
+		}
 	}
+	return strings.Join(parts, sep)
+}
+
+// XPN name type codes (HL7 table 0200) and their FHIR HumanName.use equivalents
+var nameUses = map[string]string{
+	"L": "official",
+	"D": "usual",
+	"A": "usual",
+	"M": "maiden",
+	"N": "nickname",
+	"S": "anonymous",
+}
 
-	// If both parsing attempts fail, return an error
-	return "", fmt.Errorf("invalid HL7 date format: %s", input)
+func parsePersonName(rep Repetition) PersonName {
+	name := PersonName{
+		Family: rep.Subcomponent(1, 1),
+		Given:  []string{},
+		Suffix: rep.Component(4),
+		Prefix: rep.Component(5),
+		Use:    nameUses[rep.Component(7)],
+	}
+	for _, given := range []string{rep.Component(2), rep.Component(3)} {
+		if given != "" {
+			name.Given = append(name.Given, given)
+		}
+	}
+	return name
 }
 
+func (p *hl7Parser) addError(seg Segment, field int, reason string) {
+	p.errs = append(p.errs, &ParseError{Segment: seg.Name, Line: seg.Line, Field: field, Reason: reason})
+}
+
+// required records an error for each of the given fields that is empty and
+// reports whether they were all present
+func (p *hl7Parser) required(seg Segment, fields ...int) bool {
+	ok := true
+	for _, n := range fields {
+		if seg.Field(n) == "" {
+			p.addError(seg, n, "required field is missing")
+			ok = false
+		}
+	}
+	return ok
+}
+
+// date parses an optional date field, recording an error if it is present but
+// malformed. The legacy TS degree of precision component is ignored.
+func (p *hl7Parser) date(seg Segment, field int) string {
+	value := seg.Component(field, 1)
+	if value == "" {
+		return ""
+	}
+	date, err := parseHL7DateOrDateTime(value, p.zone)
+	if err != nil {
+		p.addError(seg, field, err.Error())
+	}
+	return date
+}
+
+// instant parses a date field for a FHIR instant, which unlike a dateTime needs
+// the seconds and a known UTC offset, either in the value itself or in MSH-7.
+// Less precise values give "".
+func (p *hl7Parser) instant(seg Segment, field int) string {
+	date := p.date(seg, field)
+	value := seg.Component(field, 1)
+	if i := strings.IndexAny(value, ".+-"); i >= 0 {
+		value = value[:i]
+	}
+	if len(value) < len("YYYYMMDDHHMMSS") || (hl7Offset(seg.Component(field, 1)) == "" && p.zone == "") {
+		return ""
+	}
+	return date
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNextOfKin(t *testing.T) {
+	tests := []struct {
+		name     string
+		segment  string
+		want     string
+		wantErrs int
+	}{
+		{
+			name:    "relationship, phone and address",
+			segment: "NK1|1|Smith^John^A^Jr^Mr^^L|SPO^Spouse^HL70063|1 High St^^Leeds^^LS1 1AA^GB^H|07700900123",
+			want: `{"relationship":[{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/v2-0063","code":"SPO","display":"Spouse"}],"text":"Spouse"}],` +
+				`"name":{"use":"official","family":"Smith","given":["John","A"],"prefix":["Mr"],"suffix":["Jr"]},` +
+				`"telecom":[{"system":"phone","value":"07700900123"}],` +
+				`"address":{"use":"home","line":["1 High St"],"city":"Leeds","postalCode":"LS1 1AA","country":"GB"}}`,
+		},
+		{
+			name:    "contact role is a second relationship",
+			segment: "NK1|1|Smith^Anne|MTH^Mother||||C^Emergency Contact",
+			want: `{"relationship":[{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/v2-0063","code":"MTH","display":"Mother"}],"text":"Mother"},` +
+				`{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/v2-0131","code":"C","display":"Emergency Contact"}],"text":"Emergency Contact"}],` +
+				`"name":{"family":"Smith","given":["Anne"]}}`,
+		},
+		{
+			name:    "other coding systems are kept",
+			segment: "NK1|1|Smith^Anne|72705000^Mother^SCT",
+			want: `{"relationship":[{"coding":[{"system":"http://snomed.info/sct","code":"72705000","display":"Mother"}],"text":"Mother"}],` +
+				`"name":{"family":"Smith","given":["Anne"]}}`,
+		},
+		{
+			name:    "uncoded relationship is text only",
+			segment: "NK1|1|Smith^Anne|^Neighbour",
+			want:    `{"relationship":[{"text":"Neighbour"}],"name":{"family":"Smith","given":["Anne"]}}`,
+		},
+		{
+			name:    "international phone number",
+			segment: "NK1|1|Smith^Anne|||^PRN^PH^^44^7700^900123",
+			want:    `{"name":{"family":"Smith","given":["Anne"]},"telecom":[{"system":"phone","value":"+44 7700900123"}]}`,
+		},
+		{
+			name:     "contact without a name is skipped",
+			segment:  "NK1|1||SPO^Spouse",
+			wantErrs: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := "MSH|^~\\&|ADT|HOSP|||20240501103000+0100||ADT^A08|M1|P|2.5\r" +
+				"PID|1||123^^^HOSP^MR||Smith^Jane\r" +
+				tt.segment + "\r"
+
+			records, parseErrs, err := parseHL7Records(message)
+			if err != nil {
+				t.Fatalf("parseHL7Records() error = %v", err)
+			}
+			if len(parseErrs) != tt.wantErrs {
+				t.Errorf("parseHL7Records() parse errors = %v, want %d", parseErrs, tt.wantErrs)
+			}
+
+			contacts := records[0].Patient.Contacts
+			if tt.want == "" {
+				if len(contacts) != 0 {
+					t.Errorf("contacts = %+v, want none", contacts)
+				}
+				return
+			}
+			if len(contacts) != 1 {
+				t.Fatalf("contacts = %+v, want one", contacts)
+			}
+			got, err := json.Marshal(patientContact(contacts[0]))
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Patient.contact =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
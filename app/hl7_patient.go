@@ -0,0 +1,226 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	. "myapp/models"
+)
+
+// PID-8 administrative sex codes (HL7 table 0001) and their FHIR gender
+// equivalents. The HL7 null "" says the sex is unknown.
+var administrativeGenders = map[string]string{
+	"M":  "male",
+	"F":  "female",
+	"O":  "other",
+	"A":  "other",
+	"N":  "other",
+	"U":  "unknown",
+	`""`: "unknown",
+}
+
+// patient handles PID, keeping every repetition of the names, identifiers,
+// addresses and phone numbers along with the other demographics
+func (p *hl7Parser) patient(seg Segment) {
+	p.required(seg, 3, 5)
+	p.data.Patient = Patient{
+		DOB: fhirDate(p.date(seg, 7)),
+	}
+	patient := &p.data.Patient
+
+	// Empty repetitions, e.g. "~~", are skipped rather than kept as blank entries,
+	// and the single legacy fields come from the first repetition that is kept
+	for _, rep := range seg.Repetitions(5) {
+		if name := parsePersonName(rep); name.Family != "" || len(name.Given) > 0 {
+			if len(patient.Names) == 0 {
+				patient.Name, patient.Given = rep.Component(1), rep.Component(2)
+			}
+			patient.Names = append(patient.Names, name)
+		}
+	}
+	for _, rep := range seg.Repetitions(3) {
+		if identifier := parseIdentifier(rep); identifier.Value != "" {
+			if len(patient.Identifiers) == 0 {
+				patient.Organization = identifier.AssigningAuthority
+			}
+			patient.Identifiers = append(patient.Identifiers, identifier)
+		}
+	}
+	for _, rep := range seg.Repetitions(11) {
+		if address := parseAddress(rep); len(address.Lines) > 0 || address.City != "" || address.State != "" ||
+			address.PostalCode != "" || address.Country != "" {
+			// Nation stays XAD-4 as in records converted before addresses were
+			// kept, the real country (XAD-6) is in Addresses
+			if len(patient.Addresses) == 0 {
+				patient.Nation = rep.Component(4)
+			}
+			patient.Addresses = append(patient.Addresses, address)
+		}
+	}
+	for _, field := range []struct {
+		number int
+		use    string
+	}{{13, "home"}, {14, "work"}} {
+		for _, rep := range seg.Repetitions(field.number) {
+			if telecom := parseTelecom(rep, field.use); telecom.Value != "" {
+				patient.Telecoms = append(patient.Telecoms, telecom)
+			}
+		}
+	}
+
+	// An absent PID-8 leaves the gender out rather than claiming it is unknown
+	if sex := strings.ToUpper(seg.Field(8)); sex != "" {
+		gender, ok := administrativeGenders[sex]
+		if !ok {
+			p.addError(seg, 8, fmt.Sprintf("unknown administrative sex %q", seg.Field(8)))
+			gender = "unknown"
+		}
+		patient.Gender = gender
+	}
+
+	if coding := parseCoding(seg.first(15)); coding.Code != "" || coding.Display != "" {
+		patient.Language = &coding
+	}
+	if coding := parseCoding(seg.first(16)); coding.Code != "" || coding.Display != "" {
+		patient.MaritalStatus = &coding
+	}
+
+	patient.MultipleBirth = p.indicator(seg, 24)
+	if order := seg.Field(25); order != "" {
+		if n, err := strconv.Atoi(order); err == nil && n > 0 {
+			patient.BirthOrder = n
+		} else {
+			p.addError(seg, 25, "invalid birth order "+strconv.Quote(order))
+		}
+	}
+
+	patient.DeceasedDate = p.date(seg, 29)
+	patient.Deceased = p.indicator(seg, 30)
+	if patient.DeceasedDate != "" && patient.Deceased == nil {
+		deceased := true
+		patient.Deceased = &deceased
+	}
+}
+
+// indicator reads a Y/N field (HL7 table 0136), giving nil when it is empty
+func (p *hl7Parser) indicator(seg Segment, field int) *bool {
+	var value bool
+	switch strings.ToUpper(seg.Field(field)) {
+	case "":
+		return nil
+	case "Y":
+		value = true
+	case "N":
+		value = false
+	default:
+		p.addError(seg, field, "invalid indicator "+strconv.Quote(seg.Field(field)))
+		return nil
+	}
+	return &value
+}
+
+// parseIdentifier reads a CX identifier. The assigning authority's universal ID
+// (CX-4.2) becomes the system when its type (CX-4.3) says it is an OID or URI.
+func parseIdentifier(rep Repetition) Identifier {
+	identifier := Identifier{
+		Value:              rep.Component(1),
+		AssigningAuthority: rep.Subcomponent(4, 1),
+		Type:               rep.Component(5),
+	}
+	universalID := rep.Subcomponent(4, 2)
+	identifier.System = universalIDSystem(universalID, rep.Subcomponent(4, 3))
+	if identifier.AssigningAuthority == "" {
+		identifier.AssigningAuthority = universalID
+	}
+	return identifier
+}
+
+// universalIDSystem turns an HD universal ID into a URI when its type says it is an OID or URI
+func universalIDSystem(universalID string, idType string) string {
+	if universalID == "" {
+		return ""
+	}
+	switch strings.ToUpper(idType) {
+	case "ISO":
+		return "urn:oid:" + universalID
+	case "URI":
+		return universalID
+	}
+	return ""
+}
+
+// XAD-7 address type codes (HL7 table 0190) and their FHIR Address.use equivalents
+var addressUses = map[string]string{
+	"H":   "home",
+	"P":   "home",
+	"B":   "work",
+	"O":   "work",
+	"C":   "temp",
+	"BA":  "old",
+	"BDL": "old",
+}
+
+// parseAddress reads an XAD address. The street (XAD-1.1) and other
+// designation (XAD-2) become the address lines.
+func parseAddress(rep Repetition) Address {
+	address := Address{
+		City:       rep.Component(3),
+		State:      rep.Component(4),
+		PostalCode: rep.Component(5),
+		Country:    rep.Component(6),
+		Use:        addressUses[rep.Component(7)],
+	}
+	for _, line := range []string{rep.Subcomponent(1, 1), rep.Component(2)} {
+		if line != "" {
+			address.Lines = append(address.Lines, line)
+		}
+	}
+	if rep.Component(7) == "M" {
+		address.Type = "postal"
+	}
+	return address
+}
+
+// XTN-2 telecommunication use codes (HL7 table 0201) and their FHIR ContactPoint.use equivalents
+var telecomUses = map[string]string{
+	"PRN": "home",
+	"ORN": "home",
+	"VHN": "temp",
+	"WPN": "work",
+}
+
+// XTN-3 telecommunication equipment types (HL7 table 0202) and their FHIR ContactPoint.system equivalents
+var telecomSystems = map[string]string{
+	"PH":       "phone",
+	"CP":       "phone",
+	"FX":       "fax",
+	"BP":       "pager",
+	"INTERNET": "email",
+	"X.400":    "email",
+}
+
+// parseTelecom reads an XTN phone number or email address. The use falls back
+// to the one implied by the field, home for PID-13 and work for PID-14.
+func parseTelecom(rep Repetition, use string) Telecom {
+	telecom := Telecom{
+		System: telecomSystems[strings.ToUpper(rep.Component(3))],
+		Value:  formatPhone(rep),
+		Use:    use,
+	}
+	if email := rep.Component(4); email != "" || telecom.System == "email" || rep.Component(2) == "NET" {
+		telecom.System = "email"
+		if email != "" {
+			telecom.Value = email
+		}
+	}
+	if telecom.System == "" {
+		telecom.System = "phone"
+	}
+	if rep.Component(3) == "CP" {
+		telecom.Use = "mobile"
+	} else if mapped, ok := telecomUses[rep.Component(2)]; ok {
+		telecom.Use = mapped
+	}
+	return telecom
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	. "myapp/models"
+)
+
+// Message types whose RXA segments record vaccinations rather than medication administrations
+var immunizationMessageTypes = map[string]bool{
+	"VXU": true,
+	"VXR": true,
+	"VXQ": true,
+}
+
+// Message types that carry pharmacy orders, dispenses and administrations
+var pharmacyMessageTypes = map[string]bool{
+	"RDE": true,
+	"RDS": true,
+	"RAS": true,
+	"RGV": true,
+	"OMP": true,
+	"ORP": true,
+	"RRE": true,
+	"RRA": true,
+}
+
+// administration handles an RXA segment. Vaccination and pharmacy messages decide
+// what it is, and anything else falls back to whether the code is a CVX vaccine code.
+func (p *hl7Parser) administration(seg Segment) {
+	if !p.required(seg, 3, 5) {
+		return
+	}
+
+	substance := seg.first(5)
+	date := p.date(seg, 3)
+
+	isImmunization := immunizationMessageTypes[p.messageType]
+	if !isImmunization && !pharmacyMessageTypes[p.messageType] {
+		isImmunization = fhirSystem(substance.Component(3)) == codingSystemURIs["CVX"]
+	}
+
+	if isImmunization {
+		// Vaccination senders use 999 for an unknown amount, which is left out
+		var dose *Quantity
+		if seg.Field(6) != "999" {
+			dose = p.dose(seg, 6, 7)
+		}
+		immunization := Immunization{
+			Name:         codedName(substance),
+			System:       substance.Component(3),
+			Date:         date,
+			Codes:        parseCodings(substance),
+			DoseQuantity: dose,
+			Status:       administrationStatus(seg, "not-done"),
+		}
+		if immunization.System == "" {
+			immunization.System = "unknown"
+		}
+		p.data.Immunizations = append(p.data.Immunizations, immunization)
+		return
+	}
+
+	p.data.Medication = append(p.data.Medication, Medication{
+		Name:         codedName(substance),
+		Date:         date,
+		Dosage:       joinNonEmpty(" ", seg.Text(6), seg.Component(7, 2)),
+		Codes:        parseCodings(substance),
+		DoseQuantity: p.dose(seg, 6, 7),
+		Status:       administrationStatus(seg, "not-taken"),
+	})
+}
+
+// administrationStatus maps RXA-20 completion status and RXA-21 action code onto
+// the FHIR status, using notGiven for refused or not administered doses
+func administrationStatus(seg Segment, notGiven string) string {
+	if seg.Field(21) == "D" {
+		return "entered-in-error"
+	}
+	switch seg.Field(20) {
+	case "RE", "NA":
+		return notGiven
+	}
+	return "completed"
+}
+
+// prescription handles RXO and RXE. An RXE following an RXO in the same order
+// group describes the same medication as encoded by the pharmacy, so it replaces it.
+func (p *hl7Parser) prescription(seg Segment) {
+	// Field numbers differ between the requested (RXO) and encoded (RXE) segments
+	code, amount, units, instructions := 1, 2, 4, 7
+	if seg.Name == "RXE" {
+		code, amount, units, instructions = 2, 3, 5, 7
+	}
+	if !p.required(seg, code) {
+		return
+	}
+
+	medication := Medication{
+		Name:         codedName(seg.first(code)),
+		Codes:        parseCodings(seg.first(code)),
+		DoseQuantity: p.dose(seg, amount, units),
+		Dosage:       codedName(seg.first(instructions)),
+		Status:       "active",
+	}
+	if medication.Dosage == "" {
+		medication.Dosage = joinNonEmpty(" ", seg.Text(amount), seg.Component(units, 2))
+	}
+	if seg.Name == "RXE" {
+		// RXE-32 original order date, or the start of the legacy RXE-1 quantity/timing
+		medication.Date = p.date(seg, 32)
+		if medication.Date == "" {
+			if start := seg.Component(1, 4); start != "" {
+				medication.Date, _ = parseHL7DateOrDateTime(start, p.zone)
+			}
+		}
+	}
+	if medication.Date == "" && p.order != nil {
+		medication.Date = p.order.transactionDate
+	}
+
+	if seg.Name == "RXE" && p.prescribed >= 0 {
+		if medication.Date == "" {
+			medication.Date = p.data.Medication[p.prescribed].Date
+		}
+		p.data.Medication[p.prescribed] = medication
+		p.prescribed = -1
+		return
+	}
+	p.data.Medication = append(p.data.Medication, medication)
+	if seg.Name == "RXO" {
+		p.prescribed = len(p.data.Medication) - 1
+	}
+}
+
+// dose reads an amount field and its CWE units field into a quantity
+func (p *hl7Parser) dose(seg Segment, amountField int, unitsField int) *Quantity {
+	amount := seg.Field(amountField)
+	if amount == "" {
+		return nil
+	}
+	value, err := parseNumber(amount)
+	if err != nil {
+		p.addError(seg, amountField, err.Error())
+		return nil
+	}
+
+	units := seg.first(unitsField)
+	quantity := Quantity{
+		Value:  value,
+		Code:   units.Component(1),
+		Unit:   units.Component(2),
+		System: units.Component(3),
+	}
+	if quantity.Unit == "" {
+		quantity.Unit = quantity.Code
+	}
+	return &quantity
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	. "myapp/models"
+)
+
+// DG1-6 diagnosis type codes (HL7 table 0052) and their FHIR Condition.verificationStatus equivalents
+var diagnosisVerificationStatuses = map[string]string{
+	"A": "provisional",
+	"W": "provisional",
+	"F": "confirmed",
+}
+
+// PRB-13 problem confirmation status codes. Table 0389 is user-defined, so both
+// the single letter codes and the FHIR names themselves are accepted.
+var problemVerificationStatuses = map[string]string{
+	"C":                "confirmed",
+	"CONFIRMED":        "confirmed",
+	"P":                "provisional",
+	"PROVISIONAL":      "provisional",
+	"D":                "differential",
+	"DIFFERENTIAL":     "differential",
+	"R":                "refuted",
+	"REFUTED":          "refuted",
+	"U":                "unconfirmed",
+	"UNCONFIRMED":      "unconfirmed",
+	"E":                "entered-in-error",
+	"ENTERED-IN-ERROR": "entered-in-error",
+}
+
+// PRB-14 problem life cycle status codes, user-defined table 0390
+var problemClinicalStatuses = map[string]string{
+	"A":          "active",
+	"ACTIVE":     "active",
+	"RECURRENCE": "recurrence",
+	"RELAPSE":    "relapse",
+	"I":          "inactive",
+	"INACTIVE":   "inactive",
+	"REMISSION":  "remission",
+	"R":          "resolved",
+	"RESOLVED":   "resolved",
+}
+
+// The clinical statuses of a condition that has not abated
+var activeClinicalStatuses = map[string]bool{"active": true, "recurrence": true, "relapse": true}
+
+// diagnosis handles DG1, giving each repetition of DG1-3 its own Condition.
+// Diagnoses carry no life cycle, so they are taken to be active.
+func (p *hl7Parser) diagnosis(seg Segment) {
+	if !p.required(seg, 3) {
+		return
+	}
+	date := p.date(seg, 5)
+	for _, rep := range seg.Repetitions(3) {
+		name := codedName(rep)
+		if name == "" {
+			continue
+		}
+		p.data.Conditions = append(p.data.Conditions, Condition{
+			Name:               name,
+			Codes:              parseCodings(rep),
+			Date:               date,
+			ClinicalStatus:     "active",
+			VerificationStatus: diagnosisVerificationStatuses[seg.Component(6, 1)],
+		})
+	}
+}
+
+// problem handles the PRB segments of PPR problem messages. The PRB-1 action
+// code adds, updates or deletes the problem with the same PRB-4 instance ID.
+func (p *hl7Parser) problem(seg Segment) {
+	if !p.required(seg, 3) {
+		return
+	}
+
+	condition := Condition{
+		Name:          codedName(seg.first(3)),
+		Codes:         parseCodings(seg.first(3)),
+		Date:          p.date(seg, 16),
+		ID:            seg.Component(4, 1),
+		AbatementDate: p.date(seg, 9),
+	}
+	if condition.Date == "" {
+		condition.Date = p.date(seg, 7)
+	}
+
+	if status := seg.Component(13, 1); status != "" {
+		condition.VerificationStatus = problemVerificationStatuses[strings.ToUpper(status)]
+		if condition.VerificationStatus == "" {
+			p.addError(seg, 13, fmt.Sprintf("unknown problem confirmation status %q", status))
+		}
+	}
+	if status := seg.Component(14, 1); status != "" {
+		condition.ClinicalStatus = problemClinicalStatuses[strings.ToUpper(status)]
+		if condition.ClinicalStatus == "" {
+			p.addError(seg, 14, fmt.Sprintf("unknown problem life cycle status %q", status))
+		}
+	}
+	switch {
+	case condition.VerificationStatus == "entered-in-error":
+		// FHIR does not allow a clinical status on an entered-in-error condition
+		condition.ClinicalStatus = ""
+	case condition.ClinicalStatus == "" && condition.AbatementDate != "":
+		condition.ClinicalStatus = "resolved"
+	case condition.AbatementDate != "" && activeClinicalStatuses[condition.ClinicalStatus]:
+		// FHIR does not allow an abatement date on a condition that is still active
+		p.addError(seg, 9, fmt.Sprintf("resolution date given for a problem with life cycle status %q", seg.Component(14, 1)))
+		condition.AbatementDate = ""
+	case condition.ClinicalStatus == "":
+		condition.ClinicalStatus = "active"
+	}
+
+	existing := -1
+	if condition.ID != "" {
+		for i, other := range p.data.Conditions {
+			if other.ID == condition.ID {
+				existing = i
+				break
+			}
+		}
+	}
+
+	// PRB-1 action codes, HL7 table 0287
+	switch action := seg.Component(1, 1); action {
+	case "DE":
+		if existing >= 0 {
+			p.data.Conditions = append(p.data.Conditions[:existing], p.data.Conditions[existing+1:]...)
+		}
+	case "", "AD", "UP", "CO", "UC", "LI", "UN":
+		if existing >= 0 {
+			p.data.Conditions[existing] = condition
+		} else {
+			p.data.Conditions = append(p.data.Conditions, condition)
+		}
+	default:
+		p.addError(seg, 1, fmt.Sprintf("unknown problem action code %q", action))
+	}
+}
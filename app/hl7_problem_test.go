@@ -0,0 +1,139 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	. "myapp/models"
+)
+
+func TestProblem(t *testing.T) {
+	// prb builds a PRB segment established on 2024-01-01 with the given action,
+	// instance ID, problem, PRB-9 resolution date and PRB-13/PRB-14 statuses
+	prb := func(action, id, problem, resolved, confirmation, lifeCycle string) string {
+		return "PRB|" + action + "||" + problem + "|" + id + "|||20240101||" + resolved + "||||" + confirmation + "|" + lifeCycle
+	}
+	asthma := "J45^Asthma^I10"
+	eczema := "L30.9^Eczema^I10"
+
+	tests := []struct {
+		name     string
+		segments []string
+		want     []Condition
+		wantErrs int
+	}{
+		{
+			name:     "add",
+			segments: []string{prb("AD", "1", asthma, "", "C", "A"), prb("AD", "2", eczema, "", "P", "")},
+			want: []Condition{
+				{Name: "Asthma", ID: "1", Date: "2024-01-01", ClinicalStatus: "active", VerificationStatus: "confirmed"},
+				{Name: "Eczema", ID: "2", Date: "2024-01-01", ClinicalStatus: "active", VerificationStatus: "provisional"},
+			},
+		},
+		{
+			name:     "update replaces the problem with the same PRB-4",
+			segments: []string{prb("AD", "1", asthma, "", "P", "A"), prb("AD", "2", eczema, "", "", ""), prb("UP", "1", asthma, "", "C", "I")},
+			want: []Condition{
+				{Name: "Asthma", ID: "1", Date: "2024-01-01", ClinicalStatus: "inactive", VerificationStatus: "confirmed"},
+				{Name: "Eczema", ID: "2", Date: "2024-01-01", ClinicalStatus: "active"},
+			},
+		},
+		{
+			name:     "update of an unknown problem adds it",
+			segments: []string{prb("UP", "1", asthma, "", "", "")},
+			want: []Condition{
+				{Name: "Asthma", ID: "1", Date: "2024-01-01", ClinicalStatus: "active"},
+			},
+		},
+		{
+			name:     "delete removes the problem with the same PRB-4",
+			segments: []string{prb("AD", "1", asthma, "", "", ""), prb("AD", "2", eczema, "", "", ""), prb("DE", "1", asthma, "", "", "")},
+			want: []Condition{
+				{Name: "Eczema", ID: "2", Date: "2024-01-01", ClinicalStatus: "active"},
+			},
+		},
+		{
+			name:     "delete of an unknown problem does nothing",
+			segments: []string{prb("AD", "1", asthma, "", "", ""), prb("DE", "2", eczema, "", "", "")},
+			want: []Condition{
+				{Name: "Asthma", ID: "1", Date: "2024-01-01", ClinicalStatus: "active"},
+			},
+		},
+		{
+			name:     "unknown action",
+			segments: []string{prb("XX", "1", asthma, "", "", "")},
+			wantErrs: 1,
+		},
+		{
+			name:     "FHIR status names are accepted",
+			segments: []string{prb("AD", "1", asthma, "", "differential", "remission")},
+			want: []Condition{
+				{Name: "Asthma", ID: "1", Date: "2024-01-01", ClinicalStatus: "remission", VerificationStatus: "differential"},
+			},
+		},
+		{
+			name:     "unknown statuses",
+			segments: []string{prb("AD", "1", asthma, "", "Q", "Q")},
+			want: []Condition{
+				{Name: "Asthma", ID: "1", Date: "2024-01-01", ClinicalStatus: "active"},
+			},
+			wantErrs: 2,
+		},
+		{
+			name:     "resolution date without a status is resolved",
+			segments: []string{prb("AD", "1", asthma, "20240301", "", "")},
+			want: []Condition{
+				{Name: "Asthma", ID: "1", Date: "2024-01-01", AbatementDate: "2024-03-01", ClinicalStatus: "resolved"},
+			},
+		},
+		{
+			name:     "resolution date is dropped from an active problem",
+			segments: []string{prb("AD", "1", asthma, "20240301", "", "A")},
+			want: []Condition{
+				{Name: "Asthma", ID: "1", Date: "2024-01-01", ClinicalStatus: "active"},
+			},
+			wantErrs: 1,
+		},
+		{
+			name:     "resolution date is kept on an inactive problem",
+			segments: []string{prb("AD", "1", asthma, "20240301", "", "I")},
+			want: []Condition{
+				{Name: "Asthma", ID: "1", Date: "2024-01-01", AbatementDate: "2024-03-01", ClinicalStatus: "inactive"},
+			},
+		},
+		{
+			name:     "entered in error has no clinical status",
+			segments: []string{prb("AD", "1", asthma, "", "E", "A")},
+			want: []Condition{
+				{Name: "Asthma", ID: "1", Date: "2024-01-01", VerificationStatus: "entered-in-error"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := "MSH|^~\\&|EHR|HOSP|||20240501103000+0100||PPR^PC1|M1|P|2.5\r" +
+				"PID|1||123^^^HOSP^MR||Smith^Jane\r" +
+				strings.Join(tt.segments, "\r") + "\r"
+
+			records, parseErrs, err := parseHL7Records(message)
+			if err != nil {
+				t.Fatalf("parseHL7Records() error = %v", err)
+			}
+			if len(parseErrs) != tt.wantErrs {
+				t.Errorf("parseHL7Records() parse errors = %v, want %d", parseErrs, tt.wantErrs)
+			}
+
+			var got []Condition
+			for _, condition := range records[0].Conditions {
+				// The codes are covered by the golden tests
+				condition.Codes = nil
+				got = append(got, condition)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("conditions = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Delimiters holds the HL7 v2 encoding characters declared in MSH-1 and MSH-2
+type Delimiters struct {
+	Field        byte
+	Component    byte
+	Repetition   byte
+	Escape       byte
+	Subcomponent byte
+}
+
+// DefaultDelimiters are the recommended encoding characters "|^~\&"
+var DefaultDelimiters = Delimiters{
+	Field:        '|',
+	Component:    '^',
+	Repetition:   '~',
+	Escape:       '\\',
+	Subcomponent: '&',
+}
+
+// Segment is a single tokenized HL7 segment. Fields are indexed by their HL7
+// sequence number, so Field(5) on a PID segment is PID-5. For MSH the field
+// separator itself is stored as MSH-1 to keep that numbering intact.
+type Segment struct {
+	Name       string
+	Line       int
+	Fields     []string
+	Delimiters Delimiters
+}
+
+// Message is a tokenized HL7 message
+type Message struct {
+	Delimiters Delimiters
+	Segments   []Segment
+}
+
+// ParseHL7Message reads the delimiters from the MSH header and tokenizes every segment
+func ParseHL7Message(hl7Message string) (Message, error) {
+	return parseMessageLines(splitSegments(hl7Message), 1)
+}
+
+// parseMessageLines tokenizes the lines of a single message, numbering them from firstLine
+func parseMessageLines(lines []string, firstLine int) (Message, error) {
+	delimiters := DefaultDelimiters
+	for i, line := range lines {
+		if strings.HasPrefix(line, "MSH") {
+			d, err := parseDelimiters(line)
+			if err != nil {
+				return Message{}, &ParseError{Segment: "MSH", Line: firstLine + i, Field: 1, Reason: err.Error()}
+			}
+			delimiters = d
+			break
+		}
+	}
+
+	message := Message{Delimiters: delimiters}
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		segment := delimiters.tokenize(line)
+		segment.Line = firstLine + i
+		message.Segments = append(message.Segments, segment)
+	}
+	return message, nil
+}
+
+// MLLP framing bytes wrapped around messages sent over TCP
+const (
+	mllpStartBlock = '\x0b'
+	mllpEndBlock   = '\x1c'
+)
+
+// splitSegments strips MLLP framing and splits on any mix of CR, CRLF and LF
+// segment terminators
+func splitSegments(hl7Message string) []string {
+	hl7Message = strings.Map(func(r rune) rune {
+		if r == mllpStartBlock || r == mllpEndBlock {
+			return -1
+		}
+		return r
+	}, hl7Message)
+	hl7Message = strings.ReplaceAll(hl7Message, "\r\n", "\n")
+	hl7Message = strings.ReplaceAll(hl7Message, "\r", "\n")
+	return strings.Split(hl7Message, "\n")
+}
+
+// parseDelimiters reads MSH-1 and MSH-2 (or the same fields of FHS and BHS), falling back to the defaults for any
+// encoding character the sender left out
+func parseDelimiters(headerLine string) (Delimiters, error) {
+	if len(headerLine) < 4 {
+		return Delimiters{}, fmt.Errorf("segment too short to contain a field separator")
+	}
+
+	d := DefaultDelimiters
+	d.Field = headerLine[3]
+
+	encoding := headerLine[4:]
+	if i := strings.IndexByte(encoding, d.Field); i >= 0 {
+		encoding = encoding[:i]
+	}
+	targets := []*byte{&d.Component, &d.Repetition, &d.Escape, &d.Subcomponent}
+	for i := 0; i < len(encoding) && i < len(targets); i++ {
+		*targets[i] = encoding[i]
+	}
+	return d, nil
+}
+
+func (d Delimiters) tokenize(line string) Segment {
+	fields := strings.Split(line, string(d.Field))
+	segment := Segment{Name: fields[0], Delimiters: d}
+
+	if isHeaderSegment(segment.Name) {
+		// MSH-1 is the field separator itself, so shift everything along by one
+		segment.Fields = append([]string{segment.Name, string(d.Field)}, fields[1:]...)
+	} else {
+		segment.Fields = fields
+	}
+	return segment
+}
+
+// isHeaderSegment reports whether the segment declares its own delimiters in fields 1 and 2
+func isHeaderSegment(name string) bool {
+	return name == "MSH" || name == "FHS" || name == "BHS"
+}
+
+// Field returns the raw, still escaped, value of the field at the given HL7 sequence number
+func (s Segment) Field(n int) string {
+	if n < 1 || n >= len(s.Fields) {
+		return ""
+	}
+	return s.Fields[n]
+}
+
+// Repetition is one occurrence of a field that may repeat
+type Repetition struct {
+	Value      string
+	Delimiters Delimiters
+}
+
+// Repetitions splits field n into its repetitions
+func (s Segment) Repetitions(n int) []Repetition {
+	field := s.Field(n)
+	if field == "" {
+		return nil
+	}
+	if isHeaderSegment(s.Name) && n <= 2 {
+		return []Repetition{{Value: field, Delimiters: s.Delimiters}}
+	}
+	var reps []Repetition
+	for _, value := range strings.Split(field, string(s.Delimiters.Repetition)) {
+		reps = append(reps, Repetition{Value: value, Delimiters: s.Delimiters})
+	}
+	return reps
+}
+
+// Text returns the whole of field n with escape sequences decoded
+func (s Segment) Text(n int) string {
+	return s.Delimiters.DecodeEscapes(s.Field(n))
+}
+
+// Component returns the decoded component c (1-based) of the first repetition of field n
+func (s Segment) Component(n, c int) string {
+	return s.first(n).Component(c)
+}
+
+// Subcomponent returns the decoded subcomponent sc of component c of the first repetition of field n
+func (s Segment) Subcomponent(n, c, sc int) string {
+	return s.first(n).Subcomponent(c, sc)
+}
+
+func (s Segment) first(n int) Repetition {
+	reps := s.Repetitions(n)
+	if len(reps) == 0 {
+		return Repetition{Delimiters: s.Delimiters}
+	}
+	return reps[0]
+}
+
+// Text returns the whole repetition with escape sequences decoded
+func (r Repetition) Text() string {
+	return r.Delimiters.DecodeEscapes(r.Value)
+}
+
+// Component returns the decoded component c (1-based) of the repetition
+func (r Repetition) Component(c int) string {
+	return r.Delimiters.DecodeEscapes(r.Delimiters.component(r.Value, c))
+}
+
+// Subcomponent returns the decoded subcomponent sc of component c of the repetition
+func (r Repetition) Subcomponent(c, sc int) string {
+	return r.Delimiters.DecodeEscapes(r.Delimiters.subcomponent(r.Delimiters.component(r.Value, c), sc))
+}
+
+// components splits a single repetition into its components
+func (d Delimiters) components(value string) []string {
+	return strings.Split(value, string(d.Component))
+}
+
+// component returns component c (1-based) of a single repetition
+func (d Delimiters) component(value string, c int) string {
+	parts := d.components(value)
+	if c < 1 || c > len(parts) {
+		return ""
+	}
+	return parts[c-1]
+}
+
+// subcomponent returns subcomponent sc (1-based) of a single component
+func (d Delimiters) subcomponent(value string, sc int) string {
+	parts := strings.Split(value, string(d.Subcomponent))
+	if sc < 1 || sc > len(parts) {
+		return ""
+	}
+	return parts[sc-1]
+}
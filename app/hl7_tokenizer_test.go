@@ -0,0 +1,124 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenizeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		delimiters Delimiters
+		wantFields []string
+	}{
+		{
+			name:       "MSH keeps the field separator as MSH-1",
+			line:       `MSH|^~\&|LAB|HOSP|||20240501103000||ORU^R01|M1|P|2.5`,
+			delimiters: DefaultDelimiters,
+			wantFields: []string{"MSH", "|", `^~\&`, "LAB", "HOSP", "", "", "20240501103000", "", "ORU^R01", "M1", "P", "2.5"},
+		},
+		{
+			name:       "batch headers number their fields the same way",
+			line:       `BHS|^~\&|LAB`,
+			delimiters: DefaultDelimiters,
+			wantFields: []string{"BHS", "|", `^~\&`, "LAB"},
+		},
+		{
+			name:       "other segments split on the field separator",
+			line:       `PID|1||123^^^HOSP^MR~456^^^NHS||Smith^Jane`,
+			delimiters: DefaultDelimiters,
+			wantFields: []string{"PID", "1", "", "123^^^HOSP^MR~456^^^NHS", "", "Smith^Jane"},
+		},
+		{
+			name:       "custom delimiters",
+			line:       `PID#1##123*Smith`,
+			delimiters: Delimiters{Field: '#', Component: '*', Repetition: '$', Escape: '@', Subcomponent: '%'},
+			wantFields: []string{"PID", "1", "", "123*Smith"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segment := tt.delimiters.tokenize(tt.line)
+			if strings.Join(segment.Fields, "\x00") != strings.Join(tt.wantFields, "\x00") {
+				t.Fatalf("tokenize() fields = %q, want %q", segment.Fields, tt.wantFields)
+			}
+
+			fields := segment.Fields
+			if isHeaderSegment(segment.Name) {
+				fields = append([]string{fields[0]}, fields[2:]...)
+			}
+			if got := strings.Join(fields, string(tt.delimiters.Field)); got != tt.line {
+				t.Errorf("rejoined segment = %q, want %q", got, tt.line)
+			}
+		})
+	}
+}
+
+func TestParseDelimiters(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    Delimiters
+		wantErr bool
+	}{
+		{
+			name:   "recommended encoding characters",
+			header: `MSH|^~\&|LAB`,
+			want:   DefaultDelimiters,
+		},
+		{
+			name:   "custom encoding characters",
+			header: `MSH#*$@%#LAB`,
+			want:   Delimiters{Field: '#', Component: '*', Repetition: '$', Escape: '@', Subcomponent: '%'},
+		},
+		{
+			name:   "missing encoding characters fall back to the defaults",
+			header: `MSH|^~|LAB`,
+			want:   DefaultDelimiters,
+		},
+		{
+			name:    "too short for a field separator",
+			header:  `MSH`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDelimiters(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDelimiters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseDelimiters() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSegmentAccessors(t *testing.T) {
+	segment := DefaultDelimiters.tokenize(`OBX|1|TX|^Note||A\T\B&sub^second~next`)
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"field is still escaped", segment.Field(5), `A\T\B&sub^second~next`},
+		{"field past the end", segment.Field(20), ""},
+		{"component is decoded", segment.Component(5, 1), "A&B&sub"},
+		{"subcomponent splits before decoding", segment.Subcomponent(5, 1, 2), "sub"},
+		{"component of the first repetition", segment.Component(5, 2), "second"},
+		{"second repetition", segment.Repetitions(5)[1].Text(), "next"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %q, want %q", tt.got, tt.want)
+			}
+		})
+	}
+}
@@ -2,349 +2,931 @@ package app
 
 import (
 	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"myapp/fhir"
 	. "myapp/models"
 )
 
 // Converts from MongoDB JSON to FHiR JSON - we can chain this for HL7 to FHiR
 func GenerateIPSBundle(ipsRecord HL7FHIRData) (string, error) {
+	return GenerateIPSBundleWithOptions(ipsRecord, DefaultBundleOptions())
+}
+
+// GenerateIPSBundleWithOptions is GenerateIPSBundle with the output settings spelled out
+func GenerateIPSBundleWithOptions(ipsRecord HL7FHIRData, options BundleOptions) (string, error) {
+	fhirJSON, err := json.MarshalIndent(buildIPSBundle(ipsRecord, options), "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(fhirJSON), nil
+}
+
+// GenerateIPSBundles converts several records, e.g. from an HL7 batch. A single
+// record gives its document Bundle as before, several are wrapped as entries of
+// a collection Bundle.
+func GenerateIPSBundles(ipsRecords []HL7FHIRData) (string, error) {
+	return GenerateIPSBundlesWithOptions(ipsRecords, DefaultBundleOptions())
+}
+
+// GenerateIPSBundlesWithOptions is GenerateIPSBundles with the output settings spelled out
+func GenerateIPSBundlesWithOptions(ipsRecords []HL7FHIRData, options BundleOptions) (string, error) {
+	if len(ipsRecords) == 1 {
+		return GenerateIPSBundleWithOptions(ipsRecords[0], options)
+	}
+
+	collection := fhir.Bundle{
+		ID:        uuid.New().String(),
+		Type:      "collection",
+		Timestamp: time.Now().Format("2006-01-02T15:04:05.000-07:00"),
+	}
+	for _, ipsRecord := range ipsRecords {
+		collection.Entry = append(collection.Entry, fhir.BundleEntry{
+			Resource: buildIPSBundle(ipsRecord, options),
+		})
+	}
+
+	fhirJSON, err := json.MarshalIndent(collection, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(fhirJSON), nil
+}
+
+// allergyCriticality gives the FHIR criticality and reaction severity of an
+// allergy. Records converted before the two were told apart can hold "mild" or
+// "moderate" in Criticality, which are only valid as a severity.
+func allergyCriticality(allergy Allergy) (criticality string, severity string) {
+	if allergy.Criticality == "mild" || allergy.Criticality == "moderate" {
+		return "", allergy.Criticality
+	}
+	return allergy.Criticality, allergy.Severity
+}
+
+// Builds the IPS document Bundle for a single record
+func buildIPSBundle(ipsRecord HL7FHIRData, options BundleOptions) fhir.Bundle {
 	// Generate UUIDs - may drop this inline with same suggestion for web version - replace with simple ids
 	compositionUUID := uuid.New().String()
 	patientUUID := uuid.New().String()
-	practitionerUUID := uuid.New().String()
-	organizationUUID := uuid.New().String()
+	patientReference := fhir.Reference{Reference: options.reference("Patient", patientUUID)}
 
 	// Current date/time for textual reference
-	currentDateTime := time.Now().Format("2006-01-02T15:04:05.000Z")
+	currentDateTime := time.Now().Format("2006-01-02T15:04:05.000-07:00")
 
-	// Medications
-	medications := []map[string]interface{}{}
+	// Medications and the MedicationStatements pointing at them
+	medications := []*fhir.Medication{}
+	medicationStatements := []*fhir.MedicationStatement{}
 	for _, med := range ipsRecord.Medication {
-		medicationUUID := uuid.New().String()
-		medications = append(medications, map[string]interface{}{
-			"fullUrl": "urn:uuid:" + medicationUUID,
-			"resource": map[string]interface{}{
-				"resourceType": "Medication",
-				"id":           medicationUUID,
-				"code": map[string]interface{}{
-					"coding": []map[string]interface{}{
-						{"display": med.Name},
-					},
-				},
-			},
-		})
-	}
+		medication := &fhir.Medication{
+			ID:   uuid.New().String(),
+			Code: codeableConcept(med.Codes, med.Name),
+		}
+		medication.Text = medicationNarrative(medication)
+		medications = append(medications, medication)
 
-	// MedicationStatements
-	medicationStatements := []map[string]interface{}{}
-	for i, med := range medications {
-		medicationStatementUUID := uuid.New().String()
-		medicationStatements = append(medicationStatements, map[string]interface{}{
-			"fullUrl": "urn:uuid:" + medicationStatementUUID,
-			"resource": map[string]interface{}{
-				"resourceType": "MedicationStatement",
-				"id":           medicationStatementUUID,
-				"medicationReference": map[string]interface{}{
-					"reference": "Medication/" + med["resource"].(map[string]interface{})["id"].(string),
-					"display":   med["resource"].(map[string]interface{})["code"].(map[string]interface{})["coding"].([]map[string]interface{})[0]["display"].(string),
-				},
-				"subject": map[string]interface{}{
-					"reference": "Patient/" + patientUUID,
-				},
-				"effectivePeriod": map[string]interface{}{
-					"start": ipsRecord.Medication[i].Date,
-				},
-				"dosage": []map[string]interface{}{
-					{"text": ipsRecord.Medication[i].Dosage},
-				},
+		// Records converted before the status was kept have none, and FHIR requires it
+		status := med.Status
+		if status == "" {
+			status = "unknown"
+		}
+		medicationStatement := &fhir.MedicationStatement{
+			ID:     uuid.New().String(),
+			Status: status,
+			MedicationReference: &fhir.Reference{
+				Reference: options.reference("Medication", medication.ID),
+				Display:   med.Name,
 			},
-		})
+			Subject: patientReference,
+		}
+		if med.Date != "" {
+			medicationStatement.EffectivePeriod = &fhir.Period{Start: med.Date}
+		}
+		dosage := fhir.Dosage{Text: med.Dosage}
+		if med.DoseQuantity != nil {
+			dosage.DoseAndRate = []fhir.DoseAndRate{{DoseQuantity: fhirQuantity(*med.DoseQuantity)}}
+		}
+		if dosage.Text != "" || dosage.DoseAndRate != nil {
+			medicationStatement.Dosage = []fhir.Dosage{dosage}
+		}
+		medicationStatement.Text = medicationStatementNarrative(medicationStatement)
+		medicationStatements = append(medicationStatements, medicationStatement)
 	}
 
 	// AllergyIntolerances
-	allergyIntolerances := []map[string]interface{}{}
+	allergyIntolerances := []*fhir.AllergyIntolerance{}
 	for _, allergy := range ipsRecord.Allergies {
-		allergyIntoleranceUUID := uuid.New().String()
-		allergyIntolerances = append(allergyIntolerances, map[string]interface{}{
-			"fullUrl": "urn:uuid:" + allergyIntoleranceUUID,
-			"resource": map[string]interface{}{
-				"resourceType": "AllergyIntolerance",
-				"id":           allergyIntoleranceUUID,
-				"type":         "allergy",
-				"category":     []string{"medication"},
-				"criticality":  allergy.Criticality,
-				"code": map[string]interface{}{
-					"coding": []map[string]interface{}{
-						{"display": allergy.Name},
-					},
-				},
-				"patient": map[string]interface{}{
-					"reference": "Patient/" + patientUUID,
-				},
-				"onsetDateTime": allergy.Date,
-			},
-		})
+		criticality, severity := allergyCriticality(allergy)
+		// Unknown allergen types leave type and category out rather than guessing
+		allergyIntolerance := &fhir.AllergyIntolerance{
+			ID:            uuid.New().String(),
+			Type:          allergy.Type,
+			Criticality:   criticality,
+			Code:          codeableConcept(allergy.Codes, allergy.Name),
+			Patient:       patientReference,
+			OnsetDateTime: allergy.Date,
+		}
+		if allergy.Category != "" {
+			allergyIntolerance.Category = []string{allergy.Category}
+		}
+		if allergy.ClinicalStatus != "" {
+			allergyIntolerance.ClinicalStatus = statusConcept("http://terminology.hl7.org/CodeSystem/allergyintolerance-clinical", allergy.ClinicalStatus)
+		}
+		if allergy.VerificationStatus != "" {
+			allergyIntolerance.VerificationStatus = statusConcept("http://terminology.hl7.org/CodeSystem/allergyintolerance-verification", allergy.VerificationStatus)
+		}
+		if len(allergy.Reactions) > 0 {
+			reaction := fhir.AllergyIntoleranceReaction{Severity: severity}
+			for _, manifestation := range allergy.Reactions {
+				reaction.Manifestation = append(reaction.Manifestation, codeableConcept(manifestation.Codes, manifestation.Name))
+			}
+			allergyIntolerance.Reaction = []fhir.AllergyIntoleranceReaction{reaction}
+		}
+		allergyIntolerance.Text = allergyIntoleranceNarrative(allergyIntolerance)
+		allergyIntolerances = append(allergyIntolerances, allergyIntolerance)
 	}
 
 	// Conditions
-	conditions := []map[string]interface{}{}
+	conditions := []*fhir.Condition{}
 	for _, condition := range ipsRecord.Conditions {
-		conditionUUID := uuid.New().String()
-		conditions = append(conditions, map[string]interface{}{
-			"fullUrl": "urn:uuid:" + conditionUUID,
-			"resource": map[string]interface{}{
-				"resourceType": "Condition",
-				"id":           conditionUUID,
-				"code": map[string]interface{}{
-					"coding": []map[string]interface{}{
-						{"display": condition.Name},
-					},
-				},
-				"subject": map[string]interface{}{
-					"reference": "Patient/" + patientUUID,
-				},
-				"onsetDateTime": condition.Date,
-			},
-		})
+		conditionResource := &fhir.Condition{
+			ID:                uuid.New().String(),
+			Code:              codeableConcept(condition.Codes, condition.Name),
+			Subject:           patientReference,
+			OnsetDateTime:     condition.Date,
+			AbatementDateTime: condition.AbatementDate,
+		}
+		if condition.ClinicalStatus != "" {
+			conditionResource.ClinicalStatus = statusConcept("http://terminology.hl7.org/CodeSystem/condition-clinical", condition.ClinicalStatus)
+		}
+		if condition.VerificationStatus != "" {
+			conditionResource.VerificationStatus = statusConcept("http://terminology.hl7.org/CodeSystem/condition-ver-status", condition.VerificationStatus)
+		}
+		conditionResource.Text = conditionNarrative(conditionResource)
+		conditions = append(conditions, conditionResource)
 	}
 
-	// Observations
-	observations := []map[string]interface{}{}
+	// Observations - results belonging to an OBR panel are listed by its DiagnosticReport rather than the vital signs section
+	observations := []*fhir.Observation{}
+	vitalSigns := []*fhir.Observation{}
+	reportResults := map[string][]*fhir.Observation{}
 	for _, observation := range ipsRecord.Observations {
-		observationUUID := uuid.New().String()
-		observations = append(observations, map[string]interface{}{
-			"fullUrl": "urn:uuid:" + observationUUID,
-			"resource": map[string]interface{}{
-				"resourceType": "Observation",
-				"id":           observationUUID,
-				"code": map[string]interface{}{
-					"coding": []map[string]interface{}{
-						{"display": observation.Name},
-					},
-				},
-				"subject": map[string]interface{}{
-					"reference": "Patient/" + patientUUID,
-				},
-				"effectiveDateTime": observation.Date,
-				"valueString":       observation.Value,
-			},
-		})
+		observationResource := &fhir.Observation{
+			ID:                uuid.New().String(),
+			Code:              codeableConcept(observation.Codes, observation.Name),
+			Subject:           patientReference,
+			EffectiveDateTime: observation.Date,
+		}
+		setObservationValue(observationResource, observation)
+		setObservationFlags(observationResource, observation)
+		observationResource.Text = observationNarrative(observationResource)
+		observations = append(observations, observationResource)
+
+		if observation.ReportID != "" {
+			reportResults[observation.ReportID] = append(reportResults[observation.ReportID], observationResource)
+		} else {
+			vitalSigns = append(vitalSigns, observationResource)
+		}
+	}
+
+	// DiagnosticReports
+	diagnosticReports := []*fhir.DiagnosticReport{}
+	diagnosticReportResults := map[*fhir.DiagnosticReport][]*fhir.Observation{}
+	for _, report := range ipsRecord.DiagnosticReports {
+		diagnosticReport := diagnosticReportResource(uuid.New().String(), patientReference, report, referencesTo(options, reportResults[report.ID]))
+		diagnosticReports = append(diagnosticReports, diagnosticReport)
+		diagnosticReportResults[diagnosticReport] = reportResults[report.ID]
 	}
 
 	// Immunizations
-	immunizations := []map[string]interface{}{}
+	immunizations := []*fhir.Immunization{}
 	for _, immunization := range ipsRecord.Immunizations {
-		immunizationUUID := uuid.New().String()
-		immunizations = append(immunizations, map[string]interface{}{
-			"fullUrl": "urn:uuid:" + immunizationUUID,
-			"resource": map[string]interface{}{
-				"resourceType": "Immunization",
-				"id":           immunizationUUID,
-				"status":       "completed",
-				"vaccineCode": map[string]interface{}{
-					"coding": []map[string]interface{}{
-						{"system": immunization.System, "code": immunization.Name},
-					},
-				},
-				"patient": map[string]interface{}{
-					"reference": "Patient/" + patientUUID,
-				},
-				"occurrenceDateTime": immunization.Date,
-			},
-		})
+		status := immunization.Status
+		if status == "" {
+			status = "completed"
+		}
+		// Records converted before codes were kept hold the code in Name
+		vaccineCode := codeableConcept(immunization.Codes, immunization.Name)
+		if len(immunization.Codes) == 0 {
+			vaccineCode = fhir.CodeableConcept{
+				Coding: []fhir.Coding{{System: immunization.System, Code: immunization.Name}},
+			}
+		}
+
+		immunizationResource := &fhir.Immunization{
+			ID:                 uuid.New().String(),
+			Status:             status,
+			VaccineCode:        vaccineCode,
+			Patient:            patientReference,
+			OccurrenceDateTime: immunization.Date,
+		}
+		if immunization.DoseQuantity != nil {
+			immunizationResource.DoseQuantity = fhirQuantity(*immunization.DoseQuantity)
+		}
+		immunizationResource.Text = immunizationNarrative(immunizationResource)
+		immunizations = append(immunizations, immunizationResource)
 	}
 
-	// Composition
-composition := map[string]interface{}{
-	"fullUrl": "urn:uuid:" + compositionUUID,
-	"resource": map[string]interface{}{
-		"resourceType": "Composition",
-		"id":           compositionUUID,
-		"type": map[string]interface{}{
-			"coding": []map[string]interface{}{
-				{
-					"system": "http://loinc.org",
-					"code":   "60591-5",
-					"display": "Patient summary Document",
-				},
+	// Practitioners - the primary care provider and the attending doctor author the summary. Ordering
+	// providers only asked for a test, so they stay a display on the DiagnosticReport.
+	practitioners := []*fhir.Practitioner{}
+	practitionerReferences := map[string]fhir.Reference{}
+	authors := []fhir.Reference{}
+	practitionerNames := []string{ipsRecord.Patient.Practitioner}
+	if ipsRecord.Encounter != nil {
+		practitionerNames = append(practitionerNames, ipsRecord.Encounter.AttendingDoctor)
+	}
+	for _, name := range practitionerNames {
+		if _, seen := practitionerReferences[name]; name == "" || seen {
+			continue
+		}
+		practitioner := &fhir.Practitioner{
+			ID:   uuid.New().String(),
+			Name: []fhir.HumanName{{Text: name}},
+		}
+		practitioner.Text = practitionerNarrative(practitioner)
+		practitioners = append(practitioners, practitioner)
+
+		reference := options.referenceTo(practitioner)
+		reference.Display = name
+		practitionerReferences[name] = reference
+		authors = append(authors, reference)
+	}
+	if len(authors) == 0 {
+		// Composition.author is required, so say who is missing rather than point at nothing
+		authors = append(authors, fhir.Reference{Display: options.placeholderAuthor()})
+	}
+
+	// Organization - the patient's organization, or else the facility that sent the message
+	organizations := []*fhir.Organization{}
+	organizationName := ipsRecord.Patient.Organization
+	if organizationName == "" && ipsRecord.Source != nil {
+		organizationName = ipsRecord.Source.SendingFacility
+	}
+	if organizationName != "" {
+		organization := &fhir.Organization{
+			ID:   uuid.New().String(),
+			Name: organizationName,
+		}
+		organization.Text = organizationNarrative(organization)
+		organizations = append(organizations, organization)
+	}
+
+	// Encounter - the other clinical resources point at it when the message described a visit
+	encounters := []*fhir.Encounter{}
+	if ipsRecord.Encounter != nil {
+		encounter := encounterResource(uuid.New().String(), patientReference, *ipsRecord.Encounter)
+		if doctor, ok := practitionerReferences[ipsRecord.Encounter.AttendingDoctor]; ok {
+			encounter.Participant = []fhir.EncounterParticipant{{Individual: &doctor}}
+		}
+		encounters = append(encounters, encounter)
+
+		encounterReference := options.referenceTo(encounter)
+		for _, resource := range medicationStatements {
+			resource.Context = &encounterReference
+		}
+		for _, resource := range allergyIntolerances {
+			resource.Encounter = &encounterReference
+		}
+		for _, resource := range conditions {
+			resource.Encounter = &encounterReference
+		}
+		for _, resource := range observations {
+			resource.Encounter = &encounterReference
+		}
+		for _, resource := range diagnosticReports {
+			resource.Encounter = &encounterReference
+		}
+		for _, resource := range immunizations {
+			resource.Encounter = &encounterReference
+		}
+	}
+
+	patient := patientResource(patientUUID, ipsRecord.Patient, options)
+
+	// Composition - the IPS profile requires narrative on the document and on every section
+	composition := &fhir.Composition{
+		ID:     compositionUUID,
+		Status: "final",
+		Type: fhir.CodeableConcept{
+			Coding: []fhir.Coding{
+				{System: "http://loinc.org", Code: "60591-5", Display: "Patient summary Document"},
 			},
 		},
-		"subject": map[string]interface{}{
-			"reference": "Patient/" + patientUUID,
+		Subject: patientReference,
+		Date:    currentDateTime,
+		Author:  authors,
+		Title:   "Patient Summary as of " + currentDateTime,
+	}
+	composition.Section = appendSection(composition.Section, options, MedicationSection,
+		medicationSectionNarrative(medicationStatements), referencesTo(options, medicationStatements))
+	composition.Section = appendSection(composition.Section, options, AllergySection,
+		allergySectionNarrative(allergyIntolerances), referencesTo(options, allergyIntolerances))
+	composition.Section = appendSection(composition.Section, options, ProblemSection,
+		conditionSectionNarrative(conditions), referencesTo(options, conditions))
+	composition.Section = appendSection(composition.Section, options, VitalSignsSection,
+		observationSectionNarrative(vitalSigns), referencesTo(options, vitalSigns))
+	composition.Section = appendSection(composition.Section, options, ResultsSection,
+		resultsSectionNarrative(diagnosticReports, diagnosticReportResults), referencesTo(options, diagnosticReports))
+	composition.Section = appendSection(composition.Section, options, ImmunizationSection,
+		immunizationSectionNarrative(immunizations), referencesTo(options, immunizations))
+	composition.Text = compositionNarrative(composition, patient)
+	if len(organizations) > 0 {
+		custodian := options.referenceTo(organizations[0])
+		composition.Custodian = &custodian
+	}
+
+	// Bundle.timestamp is an instant, so an MSH-7 sent without a time cannot be used
+	timestamp := ipsRecord.TimeStamp
+	if len(timestamp) <= len("2006-01-02") {
+		timestamp = currentDateTime
+	}
+
+	// Provenance - the HL7 message the document was converted from
+	provenances := []*fhir.Provenance{}
+	if ipsRecord.Source != nil {
+		provenances = append(provenances, provenanceResource(uuid.New().String(), options.referenceTo(composition), *ipsRecord.Source, timestamp, options))
+	}
+
+	bundleUUID := ipsRecord.PackageUUID
+	if bundleUUID == "" {
+		bundleUUID = uuid.New().String()
+	}
+
+	// Construct FHIR Bundle
+	fhirBundle := fhir.Bundle{
+		ID:        bundleUUID,
+		Type:      "document",
+		Timestamp: timestamp,
+	}
+	if ipsRecord.Source != nil && ipsRecord.Source.ControlID != "" {
+		fhirBundle.Identifier = messageIdentifier(*ipsRecord.Source)
+	}
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, composition)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, patient)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, practitioners...)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, organizations...)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, encounters...)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, medicationStatements...)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, medications...)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, allergyIntolerances...)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, conditions...)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, observations...)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, diagnosticReports...)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, immunizations...)
+	fhirBundle.Entry = appendEntries(fhirBundle.Entry, options, provenances...)
+
+	return fhirBundle
+}
+
+// IPS section titles, LOINC displays and what the section lists, for its narrative when empty
+var ipsSections = map[IPSSection]struct{ title, display, subject string }{
+	MedicationSection:   {"Medication", "History of Medication use Narrative", "medications"},
+	AllergySection:      {"Allergies and Intolerances", "Allergies and adverse reactions Document", "allergies"},
+	ProblemSection:      {"Conditions", "Problem List", "problems"},
+	VitalSignsSection:   {"Observations", "Vital signs, weight, length, head circumference, oxygen saturation and BMI Panel", "vital signs"},
+	ResultsSection:      {"Results", "Relevant diagnostic tests/laboratory data Narrative", "results"},
+	ImmunizationSection: {"Immunizations", "Immunization Activity", "immunizations"},
+}
+
+// Adds a Composition section. FHIR does not allow a section with neither
+// entries nor an emptyReason, so an empty one is left out or given an
+// emptyReason according to the options.
+func appendSection(sections []fhir.CompositionSection, options BundleOptions, section IPSSection, text *fhir.Narrative, entries []fhir.Reference) []fhir.CompositionSection {
+	details := ipsSections[section]
+	compositionSection := fhir.CompositionSection{
+		Title: details.title,
+		Code: &fhir.CodeableConcept{
+			Coding: []fhir.Coding{{System: "http://loinc.org", Code: string(section), Display: details.display}},
 		},
-		"date":  currentDateTime,
-		"title": "Patient Summary as of " + currentDateTime,
-		"author": []map[string]interface{}{
-			{
-				"reference": "Practitioner/" + practitionerUUID,
-			},
+		Text:  text,
+		Entry: entries,
+	}
+
+	if len(entries) == 0 {
+		switch options.emptySection(section) {
+		case NilKnownSection:
+			compositionSection.Text = narrative(paragraph("No known " + details.subject))
+			compositionSection.EmptyReason = emptyReason("nilknown", "Nil Known")
+		case UnavailableSection:
+			compositionSection.Text = narrative(paragraph("No information about " + details.subject + " is available"))
+			compositionSection.EmptyReason = emptyReason("unavailable", "Unavailable")
+		default:
+			return sections
+		}
+	}
+	return append(sections, compositionSection)
+}
+
+func emptyReason(code string, display string) *fhir.CodeableConcept {
+	return &fhir.CodeableConcept{
+		Coding: []fhir.Coding{
+			{System: "http://terminology.hl7.org/CodeSystem/list-empty-reason", Code: code, Display: display},
 		},
-		"custodian": map[string]interface{}{
-			"reference": "Organization/" + organizationUUID,
+	}
+}
+
+// Lists references to resources, e.g. for the entries of a Composition section
+func referencesTo[R fhir.Resource](options BundleOptions, resources []R) []fhir.Reference {
+	references := []fhir.Reference{}
+	for _, resource := range resources {
+		references = append(references, options.referenceTo(resource))
+	}
+	return references
+}
+
+// Adds resources to the Bundle entries under their fullUrl
+func appendEntries[R fhir.Resource](entries []fhir.BundleEntry, options BundleOptions, resources ...R) []fhir.BundleEntry {
+	for _, resource := range resources {
+		entries = append(entries, fhir.BundleEntry{
+			FullURL:  options.fullURL(resource.ResourceType(), resource.ResourceID()),
+			Resource: resource,
+		})
+	}
+	return entries
+}
+
+// Identifies the source message by its MSH-10 control ID, scoped to the sending facility when it has a URI
+func messageIdentifier(source MessageHeader) *fhir.Identifier {
+	identifier := &fhir.Identifier{System: source.FacilitySystem, Value: source.ControlID}
+	if source.SendingFacility != "" {
+		identifier.Assigner = &fhir.Reference{Display: source.SendingFacility}
+	}
+	return identifier
+}
+
+// Builds the Provenance recording that the document was converted from an HL7
+// message, who sent it and, from EVN, when the event was recorded
+func provenanceResource(provenanceUUID string, target fhir.Reference, source MessageHeader, timestamp string, options BundleOptions) *fhir.Provenance {
+	recorded := source.RecordedDate
+	if len(recorded) <= len("2006-01-02") {
+		recorded = timestamp
+	}
+
+	messageType := joinNonEmpty("^", source.MessageCode, source.TriggerEvent)
+	version := "HL7"
+	if source.Version != "" {
+		version += " v" + source.Version
+	}
+	// Provenance needs an agent and FHIR does not allow an empty display
+	sender := joinNonEmpty(" at ", source.SendingApplication, source.SendingFacility)
+	if sender == "" {
+		sender = options.placeholderAuthor()
+	}
+	resource := &fhir.Provenance{
+		ID:               provenanceUUID,
+		Target:           []fhir.Reference{target},
+		OccurredDateTime: source.EventDate,
+		Recorded:         recorded,
+		Agent: []fhir.ProvenanceAgent{
+			provenanceAgent("author", "Author", sender),
 		},
-		"section": []map[string]interface{}{
+		Entity: []fhir.ProvenanceEntity{
 			{
-				"title": "Medication",
-				"code": map[string]interface{}{
-					"coding": []map[string]interface{}{
-						{
-							"system": "http://loinc.org",
-							"code":   "10160-0",
-							"display": "History of Medication use Narrative",
-						},
-					},
+				Role: "source",
+				What: fhir.Reference{
+					Identifier: messageIdentifier(source),
+					Display:    joinNonEmpty(" ", version, messageType, "message"),
 				},
-				"entry": func() []map[string]interface{} {
-					entries := []map[string]interface{}{}
-					for _, medStatement := range medicationStatements {
-						entries = append(entries, map[string]interface{}{
-							"reference": "MedicationStatement/" + medStatement["resource"].(map[string]interface{})["id"].(string),
-						})
-					}
-					return entries
-				}(),
 			},
-			{
-				"title": "Allergies and Intolerances",
-				"code": map[string]interface{}{
-					"coding": []map[string]interface{}{
-						{
-							"system": "http://loinc.org",
-							"code":   "48765-2",
-							"display": "Allergies and adverse reactions Document",
-						},
-					},
-				},
-				"entry": func() []map[string]interface{} {
-					entries := []map[string]interface{}{}
-					for _, allergy := range allergyIntolerances {
-						entries = append(entries, map[string]interface{}{
-							"reference": "AllergyIntolerance/" + allergy["resource"].(map[string]interface{})["id"].(string),
-						})
-					}
-					return entries
-				}(),
-			},
-			{
-				"title": "Conditions",
-				"code": map[string]interface{}{
-					"coding": []map[string]interface{}{
-						{
-							"system": "http://loinc.org",
-							"code":   "11450-4",
-							"display": "Problem List",
-						},
-					},
-				},
-				"entry": func() []map[string]interface{} {
-					entries := []map[string]interface{}{}
-					for _, condition := range conditions {
-						entries = append(entries, map[string]interface{}{
-							"reference": "Condition/" + condition["resource"].(map[string]interface{})["id"].(string),
-						})
-					}
-					return entries
-				}(),
+		},
+	}
+	if source.TriggerEvent != "" {
+		resource.Activity = &fhir.CodeableConcept{
+			Coding: []fhir.Coding{
+				{System: "http://terminology.hl7.org/CodeSystem/v2-0003", Code: source.TriggerEvent},
 			},
-			{
-				"title": "Observations",
-				"code": map[string]interface{}{
-					"coding": []map[string]interface{}{
-						{
-							"system": "http://loinc.org",
-							"code":   "61150-9",
-							"display": "Vital signs, weight, length, head circumference, oxygen saturation and BMI Panel",
-						},
-					},
-				},
-				"entry": func() []map[string]interface{} {
-					entries := []map[string]interface{}{}
-					for _, observation := range observations {
-						entries = append(entries, map[string]interface{}{
-							"reference": "Observation/" + observation["resource"].(map[string]interface{})["id"].(string),
-						})
-					}
-					return entries
-				}(),
+		}
+	}
+	if source.Operator != "" {
+		resource.Agent = append(resource.Agent, provenanceAgent("enterer", "Enterer", source.Operator))
+	}
+	resource.Text = provenanceNarrative(resource)
+	return resource
+}
+
+func provenanceAgent(code string, display string, who string) fhir.ProvenanceAgent {
+	return fhir.ProvenanceAgent{
+		Type: &fhir.CodeableConcept{
+			Coding: []fhir.Coding{
+				{System: "http://terminology.hl7.org/CodeSystem/provenance-participant-type", Code: code, Display: display},
 			},
+		},
+		Who: fhir.Reference{Display: who},
+	}
+}
+
+// Builds the Patient resource, keeping every name, identifier and address repetition
+func patientResource(patientUUID string, patient Patient, options BundleOptions) *fhir.Patient {
+	resource := &fhir.Patient{
+		ID:               patientUUID,
+		Gender:           patient.Gender,
+		BirthDate:        patient.DOB,
+		DeceasedBoolean:  patient.Deceased,
+		DeceasedDateTime: patient.DeceasedDate,
+	}
+	if patient.DeceasedDate != "" {
+		resource.DeceasedBoolean = nil
+	}
+
+	for _, identifier := range patient.Identifiers {
+		resource.Identifier = append(resource.Identifier, patientIdentifier(identifier, options))
+	}
+
+	for _, name := range patient.Names {
+		resource.Name = append(resource.Name, humanName(name))
+	}
+	if len(resource.Name) == 0 {
+		// Records created before repetitions were kept only have the single name
+		resource.Name = append(resource.Name, fhir.HumanName{Family: patient.Name, Given: []string{patient.Given}})
+	}
+
+	for _, telecom := range patient.Telecoms {
+		resource.Telecom = append(resource.Telecom, fhir.ContactPoint{System: telecom.System, Value: telecom.Value, Use: telecom.Use})
+	}
+
+	for _, address := range patient.Addresses {
+		resource.Address = append(resource.Address, fhirAddress(address))
+	}
+	if len(resource.Address) == 0 && patient.Nation != "" {
+		resource.Address = append(resource.Address, fhir.Address{Country: patient.Nation})
+	}
+
+	if patient.MaritalStatus != nil {
+		status := maritalStatus(*patient.MaritalStatus)
+		resource.MaritalStatus = &status
+	}
+
+	if patient.BirthOrder > 0 {
+		resource.MultipleBirthInteger = patient.BirthOrder
+	} else {
+		resource.MultipleBirthBoolean = patient.MultipleBirth
+	}
+
+	for _, contact := range patient.Contacts {
+		resource.Contact = append(resource.Contact, patientContact(contact))
+	}
+
+	if patient.Language != nil {
+		resource.Communication = []fhir.PatientCommunication{
 			{
-				"title": "Immunizations",
-				"code": map[string]interface{}{
-					"coding": []map[string]interface{}{
-						{
-							"system": "http://loinc.org",
-							"code":   "11369-6",
-							"display": "Immunization Activity",
-						},
-					},
-				},
-				"entry": func() []map[string]interface{} {
-					entries := []map[string]interface{}{}
-					for _, immunization := range immunizations {
-						entries = append(entries, map[string]interface{}{
-							"reference": "Immunization/" + immunization["resource"].(map[string]interface{})["id"].(string),
-						})
-					}
-					return entries
-				}(),
+				Language:  codeableConcept([]Coding{*patient.Language}, patient.Language.Display),
+				Preferred: true,
 			},
+		}
+	}
+	resource.Text = patientNarrative(resource)
+	return resource
+}
+
+// PID-16 marital status codes (HL7 table 0002) and the v3 MaritalStatus codes
+// FHIR expects. Unknown is not a marital status but the v3 NullFlavor UNK.
+var maritalStatuses = map[string]struct{ system, code, display string }{
+	"A": {v3MaritalStatus, "L", "Legally Separated"},
+	"E": {v3MaritalStatus, "L", "Legally Separated"},
+	"D": {v3MaritalStatus, "D", "Divorced"},
+	"M": {v3MaritalStatus, "M", "Married"},
+	"S": {v3MaritalStatus, "S", "Never Married"},
+	"W": {v3MaritalStatus, "W", "Widowed"},
+	"C": {v3MaritalStatus, "C", "Common Law"},
+	"G": {v3MaritalStatus, "T", "Domestic partner"},
+	"P": {v3MaritalStatus, "T", "Domestic partner"},
+	"R": {v3MaritalStatus, "T", "Domestic partner"},
+	"N": {v3MaritalStatus, "A", "Annulled"},
+	"I": {v3MaritalStatus, "I", "Interlocutory"},
+	"B": {v3MaritalStatus, "U", "unmarried"},
+	"U": {"http://terminology.hl7.org/CodeSystem/v3-NullFlavor", "UNK", "unknown"},
+}
+
+const v3MaritalStatus = "http://terminology.hl7.org/CodeSystem/v3-MaritalStatus"
+
+// Builds Patient.maritalStatus, translating the HL7 table 0002 code when there is a v3 equivalent
+func maritalStatus(coding Coding) fhir.CodeableConcept {
+	status, ok := maritalStatuses[coding.Code]
+	if !ok || (coding.System != "" && coding.System != "HL70002") {
+		return contactCodeableConcept(coding, "HL70002")
+	}
+	return fhir.CodeableConcept{
+		Coding: []fhir.Coding{
+			{System: status.system, Code: status.code, Display: status.display},
 		},
-	},
+		Text: coding.Display,
+	}
 }
 
+// CX-5 identifier type codes (HL7 table 0203) and their displays
+var identifierTypeDisplays = map[string]string{
+	"MR":  "Medical record number",
+	"PI":  "Patient internal identifier",
+	"PT":  "Patient external identifier",
+	"NH":  "National Health Plan Identifier",
+	"NI":  "National unique individual identifier",
+	"SS":  "Social Security number",
+	"PPN": "Passport number",
+	"DL":  "Driver's license number",
+	"MC":  "Patient's Medicare number",
+	"AN":  "Account number",
+	"VN":  "Visit number",
+}
 
-	// Construct FHIR Bundle
-fhirBundle := map[string]interface{}{
-	"resourceType": "Bundle",
-	"id":           ipsRecord.PackageUUID,
-	"type":         "document",
-	"timestamp":    ipsRecord.TimeStamp,
-	"entry": append(
-		[]map[string]interface{}{
-			// Composition Resource
-			composition,
-			// Patient Resource
-			{
-				"fullUrl": "urn:uuid:" + patientUUID,
-				"resource": map[string]interface{}{
-					"resourceType": "Patient",
-					"id":           patientUUID,
-					"name": []map[string]interface{}{
-						{"family": ipsRecord.Patient.Name, "given": []string{ipsRecord.Patient.Given}},
-					},
-					"gender":    ipsRecord.Patient.Gender,
-					"birthDate": ipsRecord.Patient.DOB,
-					"address":   []map[string]interface{}{{"country": ipsRecord.Patient.Nation}},
+// Builds a Patient.identifier entry. The system comes from the configured
+// assigning authorities first and the message's universal ID second.
+func patientIdentifier(identifier Identifier, options BundleOptions) fhir.Identifier {
+	entry := fhir.Identifier{
+		System: options.identifierSystem(identifier.AssigningAuthority, identifier.System),
+		Value:  identifier.Value,
+	}
+	if identifier.Type != "" {
+		entry.Type = &fhir.CodeableConcept{
+			Coding: []fhir.Coding{
+				{
+					System:  "http://terminology.hl7.org/CodeSystem/v2-0203",
+					Code:    identifier.Type,
+					Display: identifierTypeDisplays[identifier.Type],
 				},
 			},
-		},
-		mergeResources(
-			medicationStatements,
-			medications,
-			allergyIntolerances,
-			conditions,
-			observations,
-			immunizations,
-		)...,
-	),
+		}
+	}
+	if identifier.AssigningAuthority != "" {
+		entry.Assigner = &fhir.Reference{Display: identifier.AssigningAuthority}
+	}
+	return entry
 }
 
-	// Convert to JSON
-	fhirJSON, err := json.MarshalIndent(fhirBundle, "", "  ")
-	if err != nil {
-		return "", err
+// Builds a Patient.contact entry from an NK1 contact. The NK1-3 relationship and
+// the NK1-7 contact role (emergency contact, next of kin...) both go in relationship.
+func patientContact(contact Contact) fhir.PatientContact {
+	name := humanName(contact.Name)
+	entry := fhir.PatientContact{Name: &name}
+
+	if contact.Relationship.Code != "" || contact.Relationship.Display != "" {
+		entry.Relationship = append(entry.Relationship, contactCodeableConcept(contact.Relationship, "HL70063"))
+	}
+	if contact.Role.Code != "" || contact.Role.Display != "" {
+		entry.Relationship = append(entry.Relationship, contactCodeableConcept(contact.Role, "HL70131"))
 	}
 
-	return string(fhirJSON), nil
+	if contact.Phone != "" {
+		entry.Telecom = []fhir.ContactPoint{{System: "phone", Value: contact.Phone}}
+	}
+	if contact.Address != nil {
+		address := fhirAddress(*contact.Address)
+		entry.Address = &address
+	}
+	return entry
+}
+
+// NK1 relationship and role codes come from HL7 tables, so unless the sender
+// named another coding system they belong to the matching v2 table
+func contactCodeableConcept(coding Coding, table string) fhir.CodeableConcept {
+	if coding.System == "" {
+		coding.System = table
+	}
+	if coding.Code == "" {
+		return fhir.CodeableConcept{Text: coding.Display}
+	}
+	return codeableConcept([]Coding{coding}, coding.Display)
+}
+
+func humanName(name PersonName) fhir.HumanName {
+	entry := fhir.HumanName{Use: name.Use, Family: name.Family, Given: name.Given}
+	if name.Prefix != "" {
+		entry.Prefix = []string{name.Prefix}
+	}
+	if name.Suffix != "" {
+		entry.Suffix = []string{name.Suffix}
+	}
+	return entry
+}
+
+func fhirAddress(address Address) fhir.Address {
+	return fhir.Address{
+		Use:        address.Use,
+		Type:       address.Type,
+		Line:       address.Lines,
+		City:       address.City,
+		State:      address.State,
+		PostalCode: address.PostalCode,
+		Country:    address.Country,
+	}
+}
+
+// Picks the value[x] element matching the typed OBX value, falling back to the text
+func setObservationValue(resource *fhir.Observation, observation Observation) {
+	switch {
+	case observation.Quantity != nil:
+		resource.ValueQuantity = fhirQuantity(*observation.Quantity)
+	case observation.Range != nil:
+		valueRange := &fhir.Range{}
+		if observation.Range.Low != nil {
+			valueRange.Low = fhirQuantity(*observation.Range.Low)
+		}
+		if observation.Range.High != nil {
+			valueRange.High = fhirQuantity(*observation.Range.High)
+		}
+		resource.ValueRange = valueRange
+	case observation.Ratio != nil:
+		resource.ValueRatio = &fhir.Ratio{
+			Numerator:   fhirQuantity(observation.Ratio.Numerator),
+			Denominator: fhirQuantity(observation.Ratio.Denominator),
+		}
+	case observation.CodedValue != nil:
+		value := codeableConcept([]Coding{*observation.CodedValue}, observation.CodedValue.Display)
+		resource.ValueCodeableConcept = &value
+	case observation.DateTime != "":
+		resource.ValueDateTime = observation.DateTime
+	default:
+		resource.ValueString = observation.Value
+	}
+}
+
+// v3 ObservationInterpretation displays for the OBX-8 abnormal flags (HL7 table 0078) that share its codes
+var interpretationDisplays = map[string]string{
+	"L":   "Low",
+	"H":   "High",
+	"LL":  "Critical low",
+	"HH":  "Critical high",
+	"LU":  "Significantly low",
+	"HU":  "Significantly high",
+	"<":   "Off scale low",
+	">":   "Off scale high",
+	"N":   "Normal",
+	"A":   "Abnormal",
+	"AA":  "Critical abnormal",
+	"U":   "Significant change up",
+	"D":   "Significant change down",
+	"B":   "Better",
+	"W":   "Worse",
+	"S":   "Susceptible",
+	"R":   "Resistant",
+	"I":   "Intermediate",
+	"NEG": "Negative",
+	"POS": "Positive",
+	"IND": "Indeterminate",
+	"DET": "Detected",
+	"ND":  "Not detected",
 }
 
-// Merge resources
-func mergeResources(resources ...[]map[string]interface{}) []map[string]interface{} {
-	merged := []map[string]interface{}{}
-	for _, resourceGroup := range resources {
-		merged = append(merged, resourceGroup...)
+// Adds the result status, reference range and abnormal flag interpretation
+func setObservationFlags(resource *fhir.Observation, observation Observation) {
+	// Records converted before OBX-11 was read have no status, which FHIR requires
+	resource.Status = observation.Status
+	if resource.Status == "" {
+		resource.Status = "unknown"
+	}
+
+	if reference := observation.ReferenceRange; reference != nil {
+		referenceRange := fhir.ObservationReferenceRange{Text: reference.Text}
+		if reference.Low != nil {
+			referenceRange.Low = fhirQuantity(*reference.Low)
+		}
+		if reference.High != nil {
+			referenceRange.High = fhirQuantity(*reference.High)
+		}
+		resource.ReferenceRange = []fhir.ObservationReferenceRange{referenceRange}
+	}
+
+	for _, flag := range observation.AbnormalFlags {
+		display, known := interpretationDisplays[flag]
+		if !known {
+			resource.Interpretation = append(resource.Interpretation, fhir.CodeableConcept{Text: flag})
+			continue
+		}
+		resource.Interpretation = append(resource.Interpretation, fhir.CodeableConcept{
+			Coding: []fhir.Coding{
+				{System: "http://terminology.hl7.org/CodeSystem/v3-ObservationInterpretation", Code: flag, Display: display},
+			},
+		})
+	}
+}
+
+// Only units the sender marked as UCUM get a system and code, the rest keep the unit text
+func fhirQuantity(quantity Quantity) *fhir.Quantity {
+	fhirQuantity := &fhir.Quantity{
+		Value:      quantity.Value,
+		Comparator: quantity.Comparator,
+		Unit:       quantity.Unit,
+	}
+	if strings.EqualFold(quantity.System, "UCUM") && quantity.Code != "" {
+		fhirQuantity.System = "http://unitsofmeasure.org"
+		fhirQuantity.Code = quantity.Code
+	}
+	return fhirQuantity
+}
+
+// Builds a DiagnosticReport for an OBR panel, listing the Observations reported under it
+func diagnosticReportResource(diagnosticReportUUID string, subject fhir.Reference, report DiagnosticReport, results []fhir.Reference) *fhir.DiagnosticReport {
+	resource := &fhir.DiagnosticReport{
+		ID:                diagnosticReportUUID,
+		Status:            report.Status,
+		Code:              codeableConcept(report.Codes, report.Name),
+		Subject:           subject,
+		EffectiveDateTime: report.Date,
+		Issued:            report.Issued,
+		Result:            results,
+	}
+
+	if report.Category != "" {
+		resource.Category = []fhir.CodeableConcept{
+			{Coding: []fhir.Coding{{System: "http://terminology.hl7.org/CodeSystem/v2-0074", Code: report.Category}}},
+		}
+	}
+
+	if report.PlacerOrderNumber != "" {
+		resource.Identifier = append(resource.Identifier, orderIdentifier("PLAC", "Placer Identifier", report.PlacerOrderNumber))
+	}
+	if report.FillerOrderNumber != "" {
+		resource.Identifier = append(resource.Identifier, orderIdentifier("FILL", "Filler Identifier", report.FillerOrderNumber))
+	}
+
+	// There is no ServiceRequest in the bundle, so point at the order by its placer number
+	if report.PlacerOrderNumber != "" || report.OrderingProvider != "" {
+		basedOn := fhir.Reference{Type: "ServiceRequest"}
+		if report.PlacerOrderNumber != "" {
+			identifier := orderIdentifier("PLAC", "Placer Identifier", report.PlacerOrderNumber)
+			basedOn.Identifier = &identifier
+		}
+		if report.OrderingProvider != "" {
+			basedOn.Display = "Ordered by " + report.OrderingProvider
+		}
+		resource.BasedOn = []fhir.Reference{basedOn}
+	}
+	resource.Text = diagnosticReportNarrative(resource)
+	return resource
+}
+
+func orderIdentifier(typeCode string, typeDisplay string, value string) fhir.Identifier {
+	return fhir.Identifier{
+		Type: &fhir.CodeableConcept{
+			Coding: []fhir.Coding{
+				{System: "http://terminology.hl7.org/CodeSystem/v2-0203", Code: typeCode, Display: typeDisplay},
+			},
+		},
+		Value: value,
+	}
+}
+
+// v3 ActCode displays for the encounter classes produced by the HL7 parser
+var encounterClassDisplays = map[string]string{
+	"EMER":  "emergency",
+	"IMP":   "inpatient encounter",
+	"AMB":   "ambulatory",
+	"PRENC": "pre-admission",
+}
+
+// Builds the Encounter resource from the PV1/PV2 visit
+func encounterResource(encounterUUID string, subject fhir.Reference, encounter Encounter) *fhir.Encounter {
+	status := "in-progress"
+	if encounter.DischargeDate != "" {
+		status = "finished"
+	}
+
+	class := fhir.Coding{
+		System:  "http://terminology.hl7.org/CodeSystem/v3-ActCode",
+		Code:    encounter.Class,
+		Display: encounterClassDisplays[encounter.Class],
+	}
+	if encounter.Class == "" {
+		// Encounter.class is mandatory, so fall back to the v3 NullFlavor for unknown
+		class = fhir.Coding{
+			System:  "http://terminology.hl7.org/CodeSystem/v3-NullFlavor",
+			Code:    "UNK",
+			Display: "unknown",
+		}
+	}
+
+	resource := &fhir.Encounter{
+		ID:      encounterUUID,
+		Status:  status,
+		Class:   class,
+		Subject: subject,
+	}
+
+	if encounter.VisitNumber != "" {
+		resource.Identifier = []fhir.Identifier{{Value: encounter.VisitNumber}}
+	}
+	if encounter.HospitalService != "" {
+		resource.ServiceType = &fhir.CodeableConcept{Text: encounter.HospitalService}
+	}
+	if encounter.AttendingDoctor != "" {
+		resource.Participant = []fhir.EncounterParticipant{
+			{Individual: &fhir.Reference{Display: encounter.AttendingDoctor}},
+		}
+	}
+	if encounter.AdmitDate != "" || encounter.DischargeDate != "" {
+		resource.Period = &fhir.Period{Start: encounter.AdmitDate, End: encounter.DischargeDate}
+	}
+	if encounter.AdmitReason != "" {
+		resource.ReasonCode = []fhir.CodeableConcept{{Text: encounter.AdmitReason}}
+	}
+	if encounter.Location != "" {
+		resource.Location = []fhir.EncounterLocation{
+			{Location: fhir.Reference{Display: encounter.Location}},
+		}
 	}
-	return merged
+	resource.Text = encounterNarrative(resource)
+	return resource
 }
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenMessage has a little of everything that ends up in the IPS Bundle
+const goldenMessage = "MSH|^~\\&|LAB|HOSP|EHR|CLINIC|20240501103000+0100||ORU^R01|MSG1|P|2.5\r" +
+	"PID|1||9434765919^^^NHS^NH~H123^^^HOSP^MR||Smith^Jane^A^^Mrs||19800115|F|||1 High St^^Leeds^^LS1 1AA^GB\r" +
+	"PD1||||G1234^Jones^Amy^^^Dr\r" +
+	"PV1|1|O|CLINIC^101\r" +
+	"AL1|1|DA|70618^Penicillin^RXNORM|SV|Rash|20200101\r" +
+	"DG1|1||J45^Asthma^I10||20190101\r" +
+	"ORC|NW|P100|||||||20240501090000\r" +
+	"RXE|^^^20240501|1049630^Acetaminophen 325 MG Oral Tablet^RXNORM|2||TAB^tablet|||||\r" +
+	"ORC|RE|PL123|FL456\r" +
+	"OBR|1|PL123|FL456|24331-1^Lipid panel^LN|||20240501083000|||||||||||||||20240501100000||CH|F\r" +
+	"OBX|1|NM|2093-3^Cholesterol^LN||5.20|mmol/L^mmol/L^UCUM|3.0-5.0|H|||F|||20240501083000\r" +
+	"OBX|2|NM|8867-4^Heart rate^LN||72|/min^/min^UCUM|||||F|||20240501083000\r" +
+	"RXA|0|1|20240101||08^Hep B^CVX|0.5|mL^milliliters^UCUM||||||||||||CP|A\r"
+
+// minimalMessage has nothing for any of the sections
+const minimalMessage = "MSH|^~\\&|ADT|HOSP|EHR|CLINIC|20240501103000+0100||ADT^A08|MSG2|P|2.5\r" +
+	"PID|1||H123^^^HOSP^MR||Smith^Jane||19800115|F\r"
+
+var (
+	uuidPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+	// The Bundle and Composition are stamped with the time of the conversion
+	nowPattern = regexp.MustCompile(`\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}([+-]\d\d:\d\d|Z)`)
+)
+
+// normalizeBundle replaces the generated UUIDs, numbered in order of first use
+// so the references still show what they point at, and the conversion time
+func normalizeBundle(bundle []byte) []byte {
+	ids := map[string]string{}
+	bundle = uuidPattern.ReplaceAllFunc(bundle, func(id []byte) []byte {
+		if _, ok := ids[string(id)]; !ok {
+			ids[string(id)] = fmt.Sprintf("uuid-%d", len(ids)+1)
+		}
+		return []byte(ids[string(id)])
+	})
+	return nowPattern.ReplaceAll(bundle, []byte("<now>"))
+}
+
+func TestBuildIPSBundleGolden(t *testing.T) {
+	relative := DefaultBundleOptions()
+	relative.ReferenceStrategy = RelativeReferences
+	relative.BaseURL = "https://fhir.example.org/"
+
+	omitEmpty := DefaultBundleOptions()
+	omitEmpty.EmptySections = map[IPSSection]EmptySectionPolicy{}
+
+	tests := []struct {
+		name    string
+		message string
+		options BundleOptions
+		golden  string
+	}{
+		{"default options", goldenMessage, DefaultBundleOptions(), "ips_bundle.golden.json"},
+		{"relative references", goldenMessage, relative, "ips_bundle_relative.golden.json"},
+		{"empty sections unavailable", minimalMessage, DefaultBundleOptions(), "ips_bundle_minimal.golden.json"},
+		{"empty sections omitted", minimalMessage, omitEmpty, "ips_bundle_minimal_omit_empty.golden.json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, parseErrs, err := parseHL7Records(tt.message)
+			if err != nil || len(parseErrs) > 0 {
+				t.Fatalf("parseHL7Records() error = %v, parse errors = %v", err, parseErrs)
+			}
+
+			bundle, err := json.MarshalIndent(buildIPSBundle(records[0], tt.options), "", "  ")
+			if err != nil {
+				t.Fatalf("json.MarshalIndent() error = %v", err)
+			}
+			got := normalizeBundle(append(bundle, '\n'))
+
+			path := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("reading golden file: %v (run go test -update to create it)", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("bundle does not match %s, run go test -update and review the diff\n%s", path, got)
+			}
+		})
+	}
+}
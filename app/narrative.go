@@ -0,0 +1,394 @@
+package app
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"myapp/fhir"
+)
+
+// narrative wraps XHTML content in the div a FHIR text element requires
+func narrative(content string) *fhir.Narrative {
+	return &fhir.Narrative{
+		Status: "generated",
+		Div:    `<div xmlns="http://www.w3.org/1999/xhtml">` + content + `</div>`,
+	}
+}
+
+// paragraph escapes the non-empty values and joins them into a single paragraph
+func paragraph(values ...string) string {
+	return "<p>" + html.EscapeString(joinNonEmpty(", ", values...)) + "</p>"
+}
+
+// noEntries stands in for an empty list or table, which XHTML does not allow
+const noEntries = "<p>None recorded</p>"
+
+// bulletList escapes each item into an unordered list
+func bulletList(items []string) string {
+	if len(items) == 0 {
+		return noEntries
+	}
+	var list strings.Builder
+	list.WriteString("<ul>")
+	for _, item := range items {
+		list.WriteString("<li>" + html.EscapeString(item) + "</li>")
+	}
+	list.WriteString("</ul>")
+	return list.String()
+}
+
+// table escapes the headings and cells into a table, with an optional caption
+func table(caption string, headings []string, rows [][]string) string {
+	if len(rows) == 0 && caption == "" {
+		return noEntries
+	}
+	if len(rows) == 0 {
+		return paragraph(caption) + noEntries
+	}
+	var table strings.Builder
+	table.WriteString("<table>")
+	if caption != "" {
+		table.WriteString("<caption>" + html.EscapeString(caption) + "</caption>")
+	}
+	table.WriteString("<thead><tr>")
+	for _, heading := range headings {
+		table.WriteString("<th>" + html.EscapeString(heading) + "</th>")
+	}
+	table.WriteString("</tr></thead><tbody>")
+	for _, row := range rows {
+		table.WriteString("<tr>")
+		for _, cell := range row {
+			table.WriteString("<td>" + html.EscapeString(cell) + "</td>")
+		}
+		table.WriteString("</tr>")
+	}
+	table.WriteString("</tbody></table>")
+	return table.String()
+}
+
+// conceptText picks the most readable label of a CodeableConcept
+func conceptText(concept *fhir.CodeableConcept) string {
+	if concept == nil {
+		return ""
+	}
+	if concept.Text != "" {
+		return concept.Text
+	}
+	for _, coding := range concept.Coding {
+		if coding.Display != "" {
+			return coding.Display
+		}
+	}
+	for _, coding := range concept.Coding {
+		if coding.Code != "" {
+			return coding.Code
+		}
+	}
+	return ""
+}
+
+func humanNameText(name fhir.HumanName) string {
+	if name.Text != "" {
+		return name.Text
+	}
+	parts := append(append(append([]string{}, name.Prefix...), name.Given...), name.Family)
+	return joinNonEmpty(" ", append(parts, name.Suffix...)...)
+}
+
+func quantityText(quantity *fhir.Quantity) string {
+	if quantity == nil {
+		return ""
+	}
+	return joinNonEmpty(" ", quantity.Comparator+string(quantity.Value), quantity.Unit)
+}
+
+func periodText(period *fhir.Period) string {
+	if period == nil {
+		return ""
+	}
+	if period.End == "" {
+		return period.Start
+	}
+	return period.Start + " to " + period.End
+}
+
+func dosageText(dosages []fhir.Dosage) string {
+	for _, dosage := range dosages {
+		if dosage.Text != "" {
+			return dosage.Text
+		}
+		for _, doseAndRate := range dosage.DoseAndRate {
+			if text := quantityText(doseAndRate.DoseQuantity); text != "" {
+				return text
+			}
+		}
+	}
+	return ""
+}
+
+// observationValueText renders whichever value[x] element the Observation has
+func observationValueText(observation *fhir.Observation) string {
+	switch {
+	case observation.ValueQuantity != nil:
+		return quantityText(observation.ValueQuantity)
+	case observation.ValueRange != nil:
+		return rangeText(observation.ValueRange)
+	case observation.ValueRatio != nil:
+		return quantityText(observation.ValueRatio.Numerator) + " : " + quantityText(observation.ValueRatio.Denominator)
+	case observation.ValueCodeableConcept != nil:
+		return conceptText(observation.ValueCodeableConcept)
+	case observation.ValueDateTime != "":
+		return observation.ValueDateTime
+	}
+	return observation.ValueString
+}
+
+// rangeText writes an open-ended range as a single bound rather than a dangling dash
+func rangeText(valueRange *fhir.Range) string {
+	low, high := quantityText(valueRange.Low), quantityText(valueRange.High)
+	switch {
+	case low != "" && high != "":
+		return low + " - " + high
+	case low != "":
+		return "≥ " + low
+	case high != "":
+		return "≤ " + high
+	}
+	return ""
+}
+
+func interpretationText(observation *fhir.Observation) string {
+	interpretations := []string{}
+	for i := range observation.Interpretation {
+		interpretations = append(interpretations, conceptText(&observation.Interpretation[i]))
+	}
+	return strings.Join(interpretations, ", ")
+}
+
+func referenceRangeText(observation *fhir.Observation) string {
+	for _, referenceRange := range observation.ReferenceRange {
+		if referenceRange.Text != "" {
+			return referenceRange.Text
+		}
+	}
+	return ""
+}
+
+func allergyText(allergy *fhir.AllergyIntolerance) string {
+	reactions := []string{}
+	severity := ""
+	for _, reaction := range allergy.Reaction {
+		for i := range reaction.Manifestation {
+			reactions = append(reactions, conceptText(&reaction.Manifestation[i]))
+		}
+		severity = joinNonEmpty(", ", severity, reaction.Severity)
+	}
+	details := []string{}
+	if allergy.Criticality != "" {
+		details = append(details, allergy.Criticality+" criticality")
+	}
+	if len(reactions) > 0 {
+		details = append(details, joinNonEmpty(" ", severity, "reaction: "+strings.Join(reactions, ", ")))
+	}
+	if status := conceptText(allergy.ClinicalStatus); status != "" {
+		details = append(details, status)
+	}
+	if len(details) == 0 {
+		return conceptText(&allergy.Code)
+	}
+	return fmt.Sprintf("%s (%s)", conceptText(&allergy.Code), strings.Join(details, "; "))
+}
+
+func conditionText(condition *fhir.Condition) string {
+	details := []string{}
+	if status := conceptText(condition.ClinicalStatus); status != "" {
+		details = append(details, status)
+	}
+	if condition.OnsetDateTime != "" {
+		details = append(details, "onset "+condition.OnsetDateTime)
+	}
+	if condition.AbatementDateTime != "" {
+		details = append(details, "resolved "+condition.AbatementDateTime)
+	}
+	if len(details) == 0 {
+		return conceptText(&condition.Code)
+	}
+	return fmt.Sprintf("%s (%s)", conceptText(&condition.Code), strings.Join(details, "; "))
+}
+
+func immunizationText(immunization *fhir.Immunization) string {
+	return joinNonEmpty(", ", conceptText(&immunization.VaccineCode), immunization.OccurrenceDateTime, quantityText(immunization.DoseQuantity))
+}
+
+func medicationRow(statement *fhir.MedicationStatement) []string {
+	medication := ""
+	if statement.MedicationReference != nil {
+		medication = statement.MedicationReference.Display
+	}
+	return []string{medication, statement.Status, dosageText(statement.Dosage), periodText(statement.EffectivePeriod)}
+}
+
+func observationRow(observation *fhir.Observation) []string {
+	return []string{
+		conceptText(&observation.Code),
+		observationValueText(observation),
+		referenceRangeText(observation),
+		interpretationText(observation),
+		observation.EffectiveDateTime,
+	}
+}
+
+var (
+	medicationHeadings  = []string{"Medication", "Status", "Dosage", "Date"}
+	observationHeadings = []string{"Test", "Value", "Reference range", "Interpretation", "Date"}
+)
+
+// Section narratives - a table or list of the entries, so the summary reads without resolving them
+
+func medicationSectionNarrative(statements []*fhir.MedicationStatement) *fhir.Narrative {
+	rows := [][]string{}
+	for _, statement := range statements {
+		rows = append(rows, medicationRow(statement))
+	}
+	return narrative(table("", medicationHeadings, rows))
+}
+
+func allergySectionNarrative(allergies []*fhir.AllergyIntolerance) *fhir.Narrative {
+	items := []string{}
+	for _, allergy := range allergies {
+		items = append(items, allergyText(allergy))
+	}
+	return narrative(bulletList(items))
+}
+
+func conditionSectionNarrative(conditions []*fhir.Condition) *fhir.Narrative {
+	items := []string{}
+	for _, condition := range conditions {
+		items = append(items, conditionText(condition))
+	}
+	return narrative(bulletList(items))
+}
+
+func observationSectionNarrative(observations []*fhir.Observation) *fhir.Narrative {
+	rows := [][]string{}
+	for _, observation := range observations {
+		rows = append(rows, observationRow(observation))
+	}
+	return narrative(table("", observationHeadings, rows))
+}
+
+// resultsSectionNarrative gives each report a table of the results reported under it
+func resultsSectionNarrative(reports []*fhir.DiagnosticReport, results map[*fhir.DiagnosticReport][]*fhir.Observation) *fhir.Narrative {
+	if len(reports) == 0 {
+		return narrative(noEntries)
+	}
+	var content strings.Builder
+	for _, report := range reports {
+		rows := [][]string{}
+		for _, observation := range results[report] {
+			rows = append(rows, observationRow(observation))
+		}
+		caption := joinNonEmpty(", ", conceptText(&report.Code), report.Status, report.EffectiveDateTime)
+		content.WriteString(table(caption, observationHeadings, rows))
+	}
+	return narrative(content.String())
+}
+
+func immunizationSectionNarrative(immunizations []*fhir.Immunization) *fhir.Narrative {
+	items := []string{}
+	for _, immunization := range immunizations {
+		items = append(items, immunizationText(immunization))
+	}
+	return narrative(bulletList(items))
+}
+
+// Resource narratives - a line or two naming what the resource records
+
+func compositionNarrative(composition *fhir.Composition, patient *fhir.Patient) *fhir.Narrative {
+	authors := []string{}
+	for _, author := range composition.Author {
+		authors = append(authors, author.Display)
+	}
+	patientName := ""
+	if len(patient.Name) > 0 {
+		patientName = humanNameText(patient.Name[0])
+	}
+	return narrative("<h1>" + html.EscapeString(composition.Title) + "</h1>" +
+		paragraph("Patient: "+patientName, patient.BirthDate, patient.Gender) +
+		paragraph("Author: "+strings.Join(authors, ", ")))
+}
+
+func patientNarrative(patient *fhir.Patient) *fhir.Narrative {
+	names := []string{}
+	for _, name := range patient.Name {
+		names = append(names, humanNameText(name))
+	}
+	identifiers := []string{}
+	for _, identifier := range patient.Identifier {
+		identifiers = append(identifiers, identifier.Value)
+	}
+	return narrative(paragraph(strings.Join(names, " / "), patient.Gender, patient.BirthDate) +
+		paragraph(strings.Join(identifiers, ", ")))
+}
+
+func practitionerNarrative(practitioner *fhir.Practitioner) *fhir.Narrative {
+	names := []string{}
+	for _, name := range practitioner.Name {
+		names = append(names, humanNameText(name))
+	}
+	return narrative(paragraph(names...))
+}
+
+func organizationNarrative(organization *fhir.Organization) *fhir.Narrative {
+	return narrative(paragraph(organization.Name))
+}
+
+func encounterNarrative(encounter *fhir.Encounter) *fhir.Narrative {
+	class := encounter.Class.Display
+	if class == "" {
+		class = encounter.Class.Code
+	}
+	reasons := []string{}
+	for i := range encounter.ReasonCode {
+		reasons = append(reasons, conceptText(&encounter.ReasonCode[i]))
+	}
+	return narrative(paragraph(class, encounter.Status, conceptText(encounter.ServiceType), periodText(encounter.Period), strings.Join(reasons, ", ")))
+}
+
+func medicationNarrative(medication *fhir.Medication) *fhir.Narrative {
+	return narrative(paragraph(conceptText(&medication.Code)))
+}
+
+func medicationStatementNarrative(statement *fhir.MedicationStatement) *fhir.Narrative {
+	return narrative(paragraph(medicationRow(statement)...))
+}
+
+func allergyIntoleranceNarrative(allergy *fhir.AllergyIntolerance) *fhir.Narrative {
+	return narrative(paragraph(allergyText(allergy)))
+}
+
+func conditionNarrative(condition *fhir.Condition) *fhir.Narrative {
+	return narrative(paragraph(conditionText(condition)))
+}
+
+func observationNarrative(observation *fhir.Observation) *fhir.Narrative {
+	row := observationRow(observation)
+	return narrative(paragraph(row[0]+": "+row[1], row[2], row[3], row[4]))
+}
+
+func diagnosticReportNarrative(report *fhir.DiagnosticReport) *fhir.Narrative {
+	return narrative(paragraph(conceptText(&report.Code), report.Status, report.EffectiveDateTime, fmt.Sprintf("%d results", len(report.Result))))
+}
+
+func immunizationNarrative(immunization *fhir.Immunization) *fhir.Narrative {
+	return narrative(paragraph(immunizationText(immunization), immunization.Status))
+}
+
+func provenanceNarrative(provenance *fhir.Provenance) *fhir.Narrative {
+	sources := []string{}
+	for _, entity := range provenance.Entity {
+		sources = append(sources, entity.What.Display)
+	}
+	return narrative(paragraph("Converted from "+joinNonEmpty(", ", sources...), "recorded "+provenance.Recorded))
+}
@@ -3,31 +3,58 @@ package app
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
+
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/storage"
 )
 
 func SaveToFile(convertedJSON string, parentWindow fyne.Window) {
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(convertedJSON), &data); err != nil {
-		dialog.ShowError(err, parentWindow)
+	// Batches come out as a JSON array or as NDJSON, so count the top level values
+	var values []interface{}
+	decoder := json.NewDecoder(strings.NewReader(convertedJSON))
+	for decoder.More() {
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			dialog.ShowError(err, parentWindow)
+			return
+		}
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		dialog.ShowError(fmt.Errorf("nothing to save"), parentWindow)
 		return
 	}
 
-	patientName := "Unknown"
-	packageUUID := "Unknown"
+	extension := ".json"
+	if len(values) > 1 {
+		extension = ".ndjson"
+	}
 
-	if patient, ok := data["patient"].(map[string]interface{}); ok {
-		if name, exists := patient["name"].(string); exists {
-			patientName = name
+	var defaultFilename string
+	data, isObject := values[0].(map[string]interface{})
+	switch {
+	case len(values) > 1:
+		defaultFilename = fmt.Sprintf("batch_%d_records%s", len(values), extension)
+	case !isObject:
+		records, _ := values[0].([]interface{})
+		defaultFilename = fmt.Sprintf("batch_%d_records%s", len(records), extension)
+	default:
+		patientName := "Unknown"
+		packageUUID := "Unknown"
+
+		if patient, ok := data["patient"].(map[string]interface{}); ok {
+			if name, exists := patient["name"].(string); exists {
+				patientName = name
+			}
+		}
+		if uuid, exists := data["packageUUID"].(string); exists {
+			packageUUID = uuid
 		}
-	}
-	if uuid, exists := data["packageUUID"].(string); exists {
-		packageUUID = uuid
-	}
 
-	defaultFilename := fmt.Sprintf("%s_%s.json", patientName, packageUUID)
+		defaultFilename = fmt.Sprintf("%s_%s%s", patientName, packageUUID, extension)
+	}
 
 	dialog := dialog.NewFileSave(func(writer fyne.URIWriteCloser, _ error) {
 		if writer == nil {
@@ -42,6 +69,6 @@ func SaveToFile(convertedJSON string, parentWindow fyne.Window) {
 	}, parentWindow)
 
 	dialog.SetFileName(defaultFilename)
-	dialog.SetFilter(storage.NewExtensionFileFilter([]string{".json"}))
+	dialog.SetFilter(storage.NewExtensionFileFilter([]string{extension}))
 	dialog.Show()
 }
@@ -1,9 +1,12 @@
 package app
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"encoding/json"
+	"sort"
+	"strings"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
@@ -14,7 +17,9 @@ import (
 	. "myapp/models"
 )
 
-func Run() {
+// Run shows the converter window. The options are the starting point for every
+// FHIR conversion, with the identifier systems editable in the window.
+func Run(options BundleOptions) {
 	myApp := app.New()
 	myApp.Settings().SetTheme(&myTheme{})
 	myWindow := myApp.NewWindow("HL7 to FHIR Converter")
@@ -26,12 +31,18 @@ func Run() {
 	// Dropdown for selecting conversion type
 	conversionTypes := []string{
 		"HL7 2.x to IPS MERN MongoDb JSON",
+		"HL7 2.x to IPS MERN MongoDb NDJSON",
 		"IPS MERN MongoDb JSON to IPS FHiR",
 		"HL7 2.x to IPS FHiR",
 	}
 	conversionSelect := widget.NewSelect(conversionTypes, nil)
 	conversionSelect.SetSelected(conversionTypes[0]) // Default to "HL7 to MongoDB"
 
+	// Identifier systems, one AUTHORITY=URI per line
+	systemsEntry := widget.NewMultiLineEntry()
+	systemsEntry.SetText(formatIdentifierSystems(options.IdentifierSystems))
+	systemsEntry.SetMinRowsVisible(2)
+
 	// Convert Button
 	convertButton := widget.NewButton("Convert", func() {
 		content := inputEntry.Text
@@ -40,23 +51,43 @@ func Run() {
 			return
 		}
 
+		// Each conversion gets its own options, so nothing is shared between them
+		conversionOptions := options
+		identifierSystems, err := parseIdentifierSystems(systemsEntry.Text)
+		if err != nil {
+			dialog.ShowError(err, myWindow)
+			return
+		}
+		conversionOptions.IdentifierSystems = identifierSystems
+
 		var convertedJSON string
-		var err error
 
 		switch conversionSelect.Selected {
 		case "HL7 2.x to IPS MERN MongoDb JSON":
 			convertedJSON, err = HL7toMongoDb(content)
+		case "HL7 2.x to IPS MERN MongoDb NDJSON":
+			convertedJSON, err = HL7toMongoDbNDJSON(content)
 		case "IPS MERN MongoDb JSON to IPS FHiR":
-			convertedJSON, err = GenerateIPSBundleFromMongo(content)
+			convertedJSON, err = GenerateIPSBundleFromMongo(content, conversionOptions)
 		case "HL7 2.x to IPS FHiR":
-			mongoJSON, err := HL7toMongoDb(content)
-			if err == nil {
-				convertedJSON, err = GenerateIPSBundleFromMongo(mongoJSON)
+			var mongoJSON string
+			mongoJSON, err = HL7toMongoDb(content)
+			if mongoJSON != "" {
+				var fhirErr error
+				convertedJSON, fhirErr = GenerateIPSBundleFromMongo(mongoJSON, conversionOptions)
+				if fhirErr != nil {
+					err = fhirErr
+				}
 			}
 		default:
 			err = fmt.Errorf("invalid conversion type selected")
 		}
 
+		// Parse errors are reported alongside the output rather than replacing it
+		var parseErrs ParseErrors
+		if errors.As(err, &parseErrs) && convertedJSON != "" {
+			err = nil
+		}
 		if err != nil {
 			dialog.ShowError(err, myWindow)
 			return
@@ -75,6 +106,10 @@ func Run() {
 		outputWindow.SetContent(container.NewBorder(nil, saveButton, nil, nil, outputEntry))
 		outputWindow.Resize(fyne.NewSize(600, 400))
 		outputWindow.Show()
+
+		if len(parseErrs) > 0 {
+			showParseErrors(parseErrs, outputWindow)
+		}
 	})
 
 	// File Button
@@ -98,6 +133,8 @@ func Run() {
 	myWindow.SetContent(container.NewVBox(
 		widget.NewLabel("Select Conversion Type:"),
 		conversionSelect,
+		widget.NewLabel("Identifier Systems (AUTHORITY=URI):"),
+		systemsEntry,
 		fileButton,
 		inputEntry,
 		convertButton,
@@ -106,13 +143,71 @@ func Run() {
 	myWindow.ShowAndRun()
 }
 
-// GenerateIPSBundleFromMongo wraps the GenerateIPSBundle to take string input
-func GenerateIPSBundleFromMongo(mongoJSON string) (string, error) {
-	var ipsRecord HL7FHIRData
-	err := json.Unmarshal([]byte(mongoJSON), &ipsRecord)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse MongoDB JSON: %v", err)
+// showParseErrors lists the problems found in the HL7 input, one per line
+func showParseErrors(parseErrs ParseErrors, parentWindow fyne.Window) {
+	lines := make([]string, len(parseErrs))
+	for i, parseErr := range parseErrs {
+		lines[i] = parseErr.Error()
+	}
+
+	errorList := widget.NewMultiLineEntry()
+	errorList.SetText(strings.Join(lines, "\n"))
+	errorList.Disable()
+
+	errorDialog := dialog.NewCustom(fmt.Sprintf("%d HL7 parse error(s)", len(parseErrs)), "Close", errorList, parentWindow)
+	errorDialog.Resize(fyne.NewSize(500, 300))
+	errorDialog.Show()
+}
+
+// formatIdentifierSystems lists the systems one AUTHORITY=URI per line
+func formatIdentifierSystems(systems map[string]string) string {
+	lines := []string{}
+	for authority, uri := range systems {
+		lines = append(lines, authority+"="+uri)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// parseIdentifierSystems reads the AUTHORITY=URI lines, skipping blank ones
+func parseIdentifierSystems(text string) (map[string]string, error) {
+	systems := map[string]string{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		authority, uri, ok := strings.Cut(line, "=")
+		authority, uri = strings.TrimSpace(authority), strings.TrimSpace(uri)
+		if !ok || authority == "" || uri == "" {
+			return nil, fmt.Errorf("invalid identifier system %q, expected AUTHORITY=URI", line)
+		}
+		systems[authority] = uri
+	}
+	return systems, nil
+}
+
+// GenerateIPSBundleFromMongo wraps the GenerateIPSBundle to take string input.
+// The input may be a single record, a JSON array of records or NDJSON.
+func GenerateIPSBundleFromMongo(mongoJSON string, options BundleOptions) (string, error) {
+	var ipsRecords []HL7FHIRData
+	if strings.HasPrefix(strings.TrimSpace(mongoJSON), "[") {
+		if err := json.Unmarshal([]byte(mongoJSON), &ipsRecords); err != nil {
+			return "", fmt.Errorf("failed to parse MongoDB JSON: %v", err)
+		}
+	} else {
+		decoder := json.NewDecoder(strings.NewReader(mongoJSON))
+		for decoder.More() {
+			var ipsRecord HL7FHIRData
+			if err := decoder.Decode(&ipsRecord); err != nil {
+				return "", fmt.Errorf("failed to parse MongoDB JSON: %v", err)
+			}
+			ipsRecords = append(ipsRecords, ipsRecord)
+		}
+	}
+	if len(ipsRecords) == 0 {
+		return "", fmt.Errorf("failed to parse MongoDB JSON: no records found")
 	}
 
-	return GenerateIPSBundle(ipsRecord)
+	return GenerateIPSBundlesWithOptions(ipsRecords, options)
 }
@@ -0,0 +1,356 @@
+package fhir
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Resource is implemented by every resource type so it can be placed in a Bundle entry
+type Resource interface {
+	ResourceType() string
+	ResourceID() string
+}
+
+type Bundle struct {
+	ID         string        `json:"id,omitempty"`
+	Identifier *Identifier   `json:"identifier,omitempty"`
+	Type       string        `json:"type"`
+	Timestamp  string        `json:"timestamp,omitempty"`
+	Entry      []BundleEntry `json:"entry,omitempty"`
+}
+
+type BundleEntry struct {
+	FullURL  string   `json:"fullUrl,omitempty"`
+	Resource Resource `json:"resource"`
+}
+
+type Composition struct {
+	ID        string               `json:"id,omitempty"`
+	Text      *Narrative           `json:"text,omitempty"`
+	Status    string               `json:"status"`
+	Type      CodeableConcept      `json:"type"`
+	Subject   Reference            `json:"subject"`
+	Date      string               `json:"date"`
+	Author    []Reference          `json:"author"`
+	Title     string               `json:"title"`
+	Custodian *Reference           `json:"custodian,omitempty"`
+	Section   []CompositionSection `json:"section,omitempty"`
+}
+
+type CompositionSection struct {
+	Title       string           `json:"title,omitempty"`
+	Code        *CodeableConcept `json:"code,omitempty"`
+	Text        *Narrative       `json:"text,omitempty"`
+	Entry       []Reference      `json:"entry,omitempty"`
+	EmptyReason *CodeableConcept `json:"emptyReason,omitempty"`
+}
+
+type Patient struct {
+	ID                   string                 `json:"id,omitempty"`
+	Text                 *Narrative             `json:"text,omitempty"`
+	Identifier           []Identifier           `json:"identifier,omitempty"`
+	Name                 []HumanName            `json:"name,omitempty"`
+	Telecom              []ContactPoint         `json:"telecom,omitempty"`
+	Gender               string                 `json:"gender,omitempty"`
+	BirthDate            string                 `json:"birthDate,omitempty"`
+	DeceasedBoolean      *bool                  `json:"deceasedBoolean,omitempty"`
+	DeceasedDateTime     string                 `json:"deceasedDateTime,omitempty"`
+	Address              []Address              `json:"address,omitempty"`
+	MaritalStatus        *CodeableConcept       `json:"maritalStatus,omitempty"`
+	MultipleBirthBoolean *bool                  `json:"multipleBirthBoolean,omitempty"`
+	MultipleBirthInteger int                    `json:"multipleBirthInteger,omitempty"`
+	Contact              []PatientContact       `json:"contact,omitempty"`
+	Communication        []PatientCommunication `json:"communication,omitempty"`
+}
+
+type PatientContact struct {
+	Relationship []CodeableConcept `json:"relationship,omitempty"`
+	Name         *HumanName        `json:"name,omitempty"`
+	Telecom      []ContactPoint    `json:"telecom,omitempty"`
+	Address      *Address          `json:"address,omitempty"`
+}
+
+type PatientCommunication struct {
+	Language  CodeableConcept `json:"language"`
+	Preferred bool            `json:"preferred,omitempty"`
+}
+
+type Practitioner struct {
+	ID   string      `json:"id,omitempty"`
+	Text *Narrative  `json:"text,omitempty"`
+	Name []HumanName `json:"name,omitempty"`
+}
+
+type Organization struct {
+	ID   string     `json:"id,omitempty"`
+	Text *Narrative `json:"text,omitempty"`
+	Name string     `json:"name,omitempty"`
+}
+
+type Encounter struct {
+	ID          string                 `json:"id,omitempty"`
+	Text        *Narrative             `json:"text,omitempty"`
+	Identifier  []Identifier           `json:"identifier,omitempty"`
+	Status      string                 `json:"status"`
+	Class       Coding                 `json:"class"`
+	ServiceType *CodeableConcept       `json:"serviceType,omitempty"`
+	Subject     Reference              `json:"subject"`
+	Participant []EncounterParticipant `json:"participant,omitempty"`
+	Period      *Period                `json:"period,omitempty"`
+	ReasonCode  []CodeableConcept      `json:"reasonCode,omitempty"`
+	Location    []EncounterLocation    `json:"location,omitempty"`
+}
+
+type EncounterParticipant struct {
+	Individual *Reference `json:"individual,omitempty"`
+}
+
+type EncounterLocation struct {
+	Location Reference `json:"location"`
+}
+
+type Medication struct {
+	ID   string          `json:"id,omitempty"`
+	Text *Narrative      `json:"text,omitempty"`
+	Code CodeableConcept `json:"code"`
+}
+
+type MedicationStatement struct {
+	ID                  string     `json:"id,omitempty"`
+	Text                *Narrative `json:"text,omitempty"`
+	Status              string     `json:"status"`
+	MedicationReference *Reference `json:"medicationReference,omitempty"`
+	Subject             Reference  `json:"subject"`
+	Context             *Reference `json:"context,omitempty"`
+	EffectivePeriod     *Period    `json:"effectivePeriod,omitempty"`
+	Dosage              []Dosage   `json:"dosage,omitempty"`
+}
+
+type Dosage struct {
+	Text        string        `json:"text,omitempty"`
+	DoseAndRate []DoseAndRate `json:"doseAndRate,omitempty"`
+}
+
+type DoseAndRate struct {
+	DoseQuantity *Quantity `json:"doseQuantity,omitempty"`
+}
+
+type AllergyIntolerance struct {
+	ID                 string                       `json:"id,omitempty"`
+	Text               *Narrative                   `json:"text,omitempty"`
+	ClinicalStatus     *CodeableConcept             `json:"clinicalStatus,omitempty"`
+	VerificationStatus *CodeableConcept             `json:"verificationStatus,omitempty"`
+	Type               string                       `json:"type,omitempty"`
+	Category           []string                     `json:"category,omitempty"`
+	Criticality        string                       `json:"criticality,omitempty"`
+	Code               CodeableConcept              `json:"code"`
+	Patient            Reference                    `json:"patient"`
+	Encounter          *Reference                   `json:"encounter,omitempty"`
+	OnsetDateTime      string                       `json:"onsetDateTime,omitempty"`
+	Reaction           []AllergyIntoleranceReaction `json:"reaction,omitempty"`
+}
+
+type AllergyIntoleranceReaction struct {
+	Manifestation []CodeableConcept `json:"manifestation"`
+	Severity      string            `json:"severity,omitempty"`
+}
+
+type Condition struct {
+	ID                 string           `json:"id,omitempty"`
+	Text               *Narrative       `json:"text,omitempty"`
+	ClinicalStatus     *CodeableConcept `json:"clinicalStatus,omitempty"`
+	VerificationStatus *CodeableConcept `json:"verificationStatus,omitempty"`
+	Code               CodeableConcept  `json:"code"`
+	Subject            Reference        `json:"subject"`
+	Encounter          *Reference       `json:"encounter,omitempty"`
+	OnsetDateTime      string           `json:"onsetDateTime,omitempty"`
+	AbatementDateTime  string           `json:"abatementDateTime,omitempty"`
+}
+
+type Observation struct {
+	ID                   string                      `json:"id,omitempty"`
+	Text                 *Narrative                  `json:"text,omitempty"`
+	Status               string                      `json:"status"`
+	Code                 CodeableConcept             `json:"code"`
+	Subject              Reference                   `json:"subject"`
+	Encounter            *Reference                  `json:"encounter,omitempty"`
+	EffectiveDateTime    string                      `json:"effectiveDateTime,omitempty"`
+	ValueQuantity        *Quantity                   `json:"valueQuantity,omitempty"`
+	ValueCodeableConcept *CodeableConcept            `json:"valueCodeableConcept,omitempty"`
+	ValueString          string                      `json:"valueString,omitempty"`
+	ValueRange           *Range                      `json:"valueRange,omitempty"`
+	ValueRatio           *Ratio                      `json:"valueRatio,omitempty"`
+	ValueDateTime        string                      `json:"valueDateTime,omitempty"`
+	Interpretation       []CodeableConcept           `json:"interpretation,omitempty"`
+	ReferenceRange       []ObservationReferenceRange `json:"referenceRange,omitempty"`
+}
+
+type ObservationReferenceRange struct {
+	Low  *Quantity `json:"low,omitempty"`
+	High *Quantity `json:"high,omitempty"`
+	Text string    `json:"text,omitempty"`
+}
+
+type DiagnosticReport struct {
+	ID                string            `json:"id,omitempty"`
+	Text              *Narrative        `json:"text,omitempty"`
+	Identifier        []Identifier      `json:"identifier,omitempty"`
+	BasedOn           []Reference       `json:"basedOn,omitempty"`
+	Status            string            `json:"status"`
+	Category          []CodeableConcept `json:"category,omitempty"`
+	Code              CodeableConcept   `json:"code"`
+	Subject           Reference         `json:"subject"`
+	Encounter         *Reference        `json:"encounter,omitempty"`
+	EffectiveDateTime string            `json:"effectiveDateTime,omitempty"`
+	Issued            string            `json:"issued,omitempty"`
+	Result            []Reference       `json:"result,omitempty"`
+}
+
+type Immunization struct {
+	ID                 string          `json:"id,omitempty"`
+	Text               *Narrative      `json:"text,omitempty"`
+	Status             string          `json:"status"`
+	VaccineCode        CodeableConcept `json:"vaccineCode"`
+	Patient            Reference       `json:"patient"`
+	Encounter          *Reference      `json:"encounter,omitempty"`
+	OccurrenceDateTime string          `json:"occurrenceDateTime,omitempty"`
+	DoseQuantity       *Quantity       `json:"doseQuantity,omitempty"`
+}
+
+type Provenance struct {
+	ID               string             `json:"id,omitempty"`
+	Text             *Narrative         `json:"text,omitempty"`
+	Target           []Reference        `json:"target"`
+	OccurredDateTime string             `json:"occurredDateTime,omitempty"`
+	Recorded         string             `json:"recorded"`
+	Activity         *CodeableConcept   `json:"activity,omitempty"`
+	Agent            []ProvenanceAgent  `json:"agent"`
+	Entity           []ProvenanceEntity `json:"entity,omitempty"`
+}
+
+type ProvenanceAgent struct {
+	Type *CodeableConcept `json:"type,omitempty"`
+	Who  Reference        `json:"who"`
+}
+
+type ProvenanceEntity struct {
+	Role string    `json:"role"`
+	What Reference `json:"what"`
+}
+
+// marshalResource writes a resource as JSON with its resourceType as the first
+// element, the way FHIR examples and most servers lay resources out
+func marshalResource(resourceType string, elements interface{}) ([]byte, error) {
+	body, err := json.Marshal(elements)
+	if err != nil {
+		return nil, err
+	}
+	out := []byte(`{"resourceType":` + strconv.Quote(resourceType))
+	if len(body) > 2 {
+		out = append(out, ',')
+	}
+	return append(out, body[1:]...), nil
+}
+
+func (r Bundle) ResourceType() string              { return "Bundle" }
+func (r Composition) ResourceType() string         { return "Composition" }
+func (r Patient) ResourceType() string             { return "Patient" }
+func (r Practitioner) ResourceType() string        { return "Practitioner" }
+func (r Organization) ResourceType() string        { return "Organization" }
+func (r Encounter) ResourceType() string           { return "Encounter" }
+func (r Medication) ResourceType() string          { return "Medication" }
+func (r MedicationStatement) ResourceType() string { return "MedicationStatement" }
+func (r AllergyIntolerance) ResourceType() string  { return "AllergyIntolerance" }
+func (r Condition) ResourceType() string           { return "Condition" }
+func (r Observation) ResourceType() string         { return "Observation" }
+func (r DiagnosticReport) ResourceType() string    { return "DiagnosticReport" }
+func (r Immunization) ResourceType() string        { return "Immunization" }
+func (r Provenance) ResourceType() string          { return "Provenance" }
+
+func (r Bundle) ResourceID() string              { return r.ID }
+func (r Composition) ResourceID() string         { return r.ID }
+func (r Patient) ResourceID() string             { return r.ID }
+func (r Practitioner) ResourceID() string        { return r.ID }
+func (r Organization) ResourceID() string        { return r.ID }
+func (r Encounter) ResourceID() string           { return r.ID }
+func (r Medication) ResourceID() string          { return r.ID }
+func (r MedicationStatement) ResourceID() string { return r.ID }
+func (r AllergyIntolerance) ResourceID() string  { return r.ID }
+func (r Condition) ResourceID() string           { return r.ID }
+func (r Observation) ResourceID() string         { return r.ID }
+func (r DiagnosticReport) ResourceID() string    { return r.ID }
+func (r Immunization) ResourceID() string        { return r.ID }
+func (r Provenance) ResourceID() string          { return r.ID }
+
+// Each MarshalJSON converts to a local type without methods so that
+// marshalResource does not call back into it
+
+func (r Bundle) MarshalJSON() ([]byte, error) {
+	type elements Bundle
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r Composition) MarshalJSON() ([]byte, error) {
+	type elements Composition
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r Patient) MarshalJSON() ([]byte, error) {
+	type elements Patient
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r Practitioner) MarshalJSON() ([]byte, error) {
+	type elements Practitioner
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r Organization) MarshalJSON() ([]byte, error) {
+	type elements Organization
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r Encounter) MarshalJSON() ([]byte, error) {
+	type elements Encounter
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r Medication) MarshalJSON() ([]byte, error) {
+	type elements Medication
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r MedicationStatement) MarshalJSON() ([]byte, error) {
+	type elements MedicationStatement
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r AllergyIntolerance) MarshalJSON() ([]byte, error) {
+	type elements AllergyIntolerance
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r Condition) MarshalJSON() ([]byte, error) {
+	type elements Condition
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r Observation) MarshalJSON() ([]byte, error) {
+	type elements Observation
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r DiagnosticReport) MarshalJSON() ([]byte, error) {
+	type elements DiagnosticReport
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r Immunization) MarshalJSON() ([]byte, error) {
+	type elements Immunization
+	return marshalResource(r.ResourceType(), elements(r))
+}
+
+func (r Provenance) MarshalJSON() ([]byte, error) {
+	type elements Provenance
+	return marshalResource(r.ResourceType(), elements(r))
+}
@@ -0,0 +1,50 @@
+package fhir
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMarshalResource(t *testing.T) {
+	active := true
+	tests := []struct {
+		name     string
+		resource Resource
+		want     string
+	}{
+		{
+			name:     "empty resource",
+			resource: Patient{},
+			want:     `{"resourceType":"Patient"}`,
+		},
+		{
+			name:     "resourceType first, then the elements in declaration order",
+			resource: Patient{ID: "p1", Gender: "female", BirthDate: "1980-01-15", DeceasedBoolean: &active},
+			want:     `{"resourceType":"Patient","id":"p1","gender":"female","birthDate":"1980-01-15","deceasedBoolean":true}`,
+		},
+		{
+			name: "nested resources keep their own resourceType",
+			resource: Bundle{ID: "b1", Type: "collection", Entry: []BundleEntry{
+				{FullURL: "urn:uuid:o1", Resource: Organization{ID: "o1", Name: "Hospital"}},
+			}},
+			want: `{"resourceType":"Bundle","id":"b1","type":"collection","entry":[{"fullUrl":"urn:uuid:o1","resource":{"resourceType":"Organization","id":"o1","name":"Hospital"}}]}`,
+		},
+		{
+			name:     "pointer resources marshal the same way",
+			resource: &Condition{ID: "c1", Code: CodeableConcept{Text: "Asthma"}, Subject: Reference{Reference: "urn:uuid:p1"}},
+			want:     `{"resourceType":"Condition","id":"c1","code":{"text":"Asthma"},"subject":{"reference":"urn:uuid:p1"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(tt.resource)
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("json.Marshal() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
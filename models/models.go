@@ -1,51 +1,242 @@
 package models
 
+import "encoding/json"
+
 type HL7FHIRData struct {
-    PackageUUID   string       `json:"packageUUID"`
-    TimeStamp     string       `json:"timeStamp"`
-    Patient       Patient      `json:"patient"`
-    Medication    []Medication `json:"medication"`
-    Allergies     []Allergy    `json:"allergies"`
-    Conditions    []Condition  `json:"conditions"`
-    Observations  []Observation `json:"observations"`
-    Immunizations []Immunization `json:"immunizations"`
+	PackageUUID   string         `json:"packageUUID"`
+	TimeStamp     string         `json:"timeStamp"`
+	Patient       Patient        `json:"patient"`
+	Medication    []Medication   `json:"medication"`
+	Allergies     []Allergy      `json:"allergies"`
+	Conditions    []Condition    `json:"conditions"`
+	Observations  []Observation  `json:"observations"`
+	Immunizations []Immunization `json:"immunizations"`
+	Encounter     *Encounter     `json:"encounter,omitempty"`
+	// Lab panels from OBR/ORC - their results stay in Observations, linked by ReportID
+	DiagnosticReports []DiagnosticReport `json:"diagnosticReports"`
+	// The MSH/EVN details of the message the record was converted from
+	Source *MessageHeader `json:"source,omitempty"`
+}
+
+// MessageHeader records where an HL7 message came from, from MSH and EVN
+type MessageHeader struct {
+	MessageCode        string `json:"messageCode"`
+	TriggerEvent       string `json:"triggerEvent,omitempty"`
+	MessageStructure   string `json:"messageStructure,omitempty"`
+	ControlID          string `json:"controlId"`
+	ProcessingID       string `json:"processingId,omitempty"`
+	Version            string `json:"version,omitempty"`
+	SendingApplication string `json:"sendingApplication,omitempty"`
+	SendingFacility    string `json:"sendingFacility,omitempty"`
+	// FacilitySystem is the URI of the sending facility's universal ID (MSH-4.2), if any
+	FacilitySystem       string `json:"facilitySystem,omitempty"`
+	ReceivingApplication string `json:"receivingApplication,omitempty"`
+	ReceivingFacility    string `json:"receivingFacility,omitempty"`
+	// EVN-2 recorded, EVN-6 occurred and EVN-5 operator
+	RecordedDate string `json:"recordedDate,omitempty"`
+	EventDate    string `json:"eventDate,omitempty"`
+	Operator     string `json:"operator,omitempty"`
 }
 
 type Patient struct {
-    Name         string `json:"name"`
-    Given        string `json:"given"`
-    DOB          string `json:"dob"`
-    Gender       string `json:"gender"`
-    Practitioner string `json:"practitioner"`
-    Nation       string `json:"nation"`
-    Organization string `json:"organization"`
+	Name         string `json:"name"`
+	Given        string `json:"given"`
+	DOB          string `json:"dob"`
+	Gender       string `json:"gender"`
+	Practitioner string `json:"practitioner"`
+	Nation       string `json:"nation"`
+	Organization string `json:"organization"`
+	// Every repetition of PID-5, PID-3 and PID-11 - Name and Given above hold the first name
+	Names       []PersonName `json:"names,omitempty"`
+	Identifiers []Identifier `json:"identifiers,omitempty"`
+	Addresses   []Address    `json:"addresses,omitempty"`
+	// Next of kin and emergency contacts from NK1
+	Contacts []Contact `json:"contacts,omitempty"`
+	// Home (PID-13) and business (PID-14) phone numbers and email addresses
+	Telecoms      []Telecom `json:"telecoms,omitempty"`
+	MaritalStatus *Coding   `json:"maritalStatus,omitempty"`
+	Language      *Coding   `json:"language,omitempty"`
+	// MultipleBirth and Deceased are nil when the sender left PID-24 or PID-30 empty
+	MultipleBirth *bool  `json:"multipleBirth,omitempty"`
+	BirthOrder    int    `json:"birthOrder,omitempty"`
+	Deceased      *bool  `json:"deceased,omitempty"`
+	DeceasedDate  string `json:"deceasedDate,omitempty"`
+}
+
+type PersonName struct {
+	Family string   `json:"family"`
+	Given  []string `json:"given"`
+	Prefix string   `json:"prefix,omitempty"`
+	Suffix string   `json:"suffix,omitempty"`
+	Use    string   `json:"use,omitempty"`
+}
+
+type Identifier struct {
+	Value              string `json:"value"`
+	AssigningAuthority string `json:"assigningAuthority,omitempty"`
+	// Type is the CX-5 identifier type code (HL7 table 0203), e.g. MR or NH.
+	// System is the URI given by the assigning authority's universal ID, if any.
+	Type   string `json:"type,omitempty"`
+	System string `json:"system,omitempty"`
+}
+
+type Address struct {
+	Lines      []string `json:"lines,omitempty"`
+	City       string   `json:"city,omitempty"`
+	State      string   `json:"state,omitempty"`
+	PostalCode string   `json:"postalCode,omitempty"`
+	Country    string   `json:"country,omitempty"`
+	// Use and Type already hold the FHIR Address codes
+	Use  string `json:"use,omitempty"`
+	Type string `json:"type,omitempty"`
+}
+
+// Telecom is a phone number or email address. System and Use already hold the FHIR ContactPoint codes.
+type Telecom struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+	Use    string `json:"use,omitempty"`
+}
+
+type Contact struct {
+	Name         PersonName `json:"name"`
+	Relationship Coding     `json:"relationship"`
+	Role         Coding     `json:"role"`
+	Phone        string     `json:"phone,omitempty"`
+	Address      *Address   `json:"address,omitempty"`
+}
+
+// Coding is a coded value as sent in a CWE field - System is the HL7 coding system
+// name (e.g. SCT, LN, I10) and is only turned into a FHIR URI when the bundle is built
+type Coding struct {
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+	System  string `json:"system,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// Encounter is the visit described by PV1/PV2
+type Encounter struct {
+	VisitNumber     string `json:"visitNumber,omitempty"`
+	Class           string `json:"class"`
+	HospitalService string `json:"hospitalService,omitempty"`
+	Location        string `json:"location,omitempty"`
+	AttendingDoctor string `json:"attendingDoctor,omitempty"`
+	AdmitReason     string `json:"admitReason,omitempty"`
+	AdmitDate       string `json:"admitDate,omitempty"`
+	DischargeDate   string `json:"dischargeDate,omitempty"`
 }
 
 type Medication struct {
-    Name   string `json:"name"`
-    Date   string `json:"date"`
-    Dosage string `json:"dosage"`
+	Name   string `json:"name"`
+	Date   string `json:"date"`
+	Dosage string `json:"dosage"`
+	// Codes and dose come from RXA-5/6/7 for administrations or RXE/RXO for prescriptions.
+	// Status is the FHIR MedicationStatement status - completed when given, active when prescribed.
+	Codes        []Coding  `json:"codes,omitempty"`
+	DoseQuantity *Quantity `json:"doseQuantity,omitempty"`
+	Status       string    `json:"status,omitempty"`
 }
 
 type Allergy struct {
-    Name        string `json:"name"`
-    Criticality string `json:"criticality"`
-    Date        string `json:"date"`
+	Name        string   `json:"name"`
+	Codes       []Coding `json:"codes,omitempty"`
+	Criticality string   `json:"criticality"`
+	Date        string   `json:"date"`
+	// ID is the IAM-7 identifier used to match updates and deletes. Type, Category,
+	// Severity and the statuses already hold the FHIR AllergyIntolerance codes.
+	ID                 string     `json:"id,omitempty"`
+	Reactions          []Reaction `json:"reactions,omitempty"`
+	Severity           string     `json:"severity,omitempty"`
+	Type               string     `json:"type,omitempty"`
+	Category           string     `json:"category,omitempty"`
+	ClinicalStatus     string     `json:"clinicalStatus,omitempty"`
+	VerificationStatus string     `json:"verificationStatus,omitempty"`
+}
+
+// Reaction is an AL1-5/IAM-5 reaction, with the codes when the sender coded it
+type Reaction struct {
+	Name  string   `json:"name"`
+	Codes []Coding `json:"codes,omitempty"`
 }
 
 type Condition struct {
-    Name string `json:"name"`
-    Date string `json:"date"`
+	Name  string   `json:"name"`
+	Codes []Coding `json:"codes,omitempty"`
+	Date  string   `json:"date"`
+	// ID is the PRB-4 problem instance used to match updates and deletes. The
+	// statuses already hold the FHIR Condition codes.
+	ID                 string `json:"id,omitempty"`
+	AbatementDate      string `json:"abatementDate,omitempty"`
+	ClinicalStatus     string `json:"clinicalStatus,omitempty"`
+	VerificationStatus string `json:"verificationStatus,omitempty"`
 }
 
 type Observation struct {
-    Name  string `json:"name"`
-    Date  string `json:"date"`
-    Value string `json:"value"`
+	Name     string   `json:"name"`
+	Codes    []Coding `json:"codes,omitempty"`
+	Date     string   `json:"date"`
+	Value    string   `json:"value"`
+	ReportID string   `json:"reportId,omitempty"`
+	// OBX-2 value type and the typed value it selects - Value above always keeps the text
+	ValueType  string    `json:"valueType,omitempty"`
+	Quantity   *Quantity `json:"quantity,omitempty"`
+	Range      *Range    `json:"range,omitempty"`
+	Ratio      *Ratio    `json:"ratio,omitempty"`
+	CodedValue *Coding   `json:"codedValue,omitempty"`
+	DateTime   string    `json:"dateTime,omitempty"`
+	// OBX-7, OBX-8 and OBX-11 - Status is already the FHIR observation status
+	ReferenceRange *ReferenceRange `json:"referenceRange,omitempty"`
+	AbnormalFlags  []string        `json:"abnormalFlags,omitempty"`
+	Status         string          `json:"status,omitempty"`
+}
+
+// ReferenceRange keeps the OBX-7 text along with any bounds that could be read from it
+type ReferenceRange struct {
+	Low  *Quantity `json:"low,omitempty"`
+	High *Quantity `json:"high,omitempty"`
+	Text string    `json:"text"`
+}
+
+// Quantity is a number with its units - System is the HL7 coding system of the unit code, e.g. UCUM.
+// Value keeps the digits the sender wrote, as trailing zeros are significant in FHIR decimals.
+type Quantity struct {
+	Value      json.Number `json:"value"`
+	Comparator string      `json:"comparator,omitempty"`
+	Unit       string      `json:"unit,omitempty"`
+	Code       string      `json:"code,omitempty"`
+	System     string      `json:"system,omitempty"`
+}
+
+type Range struct {
+	Low  *Quantity `json:"low,omitempty"`
+	High *Quantity `json:"high,omitempty"`
+}
+
+type Ratio struct {
+	Numerator   Quantity `json:"numerator"`
+	Denominator Quantity `json:"denominator"`
+}
+
+type DiagnosticReport struct {
+	ID                string   `json:"id"`
+	Name              string   `json:"name"`
+	Codes             []Coding `json:"codes,omitempty"`
+	Category          string   `json:"category,omitempty"`
+	Status            string   `json:"status"`
+	Date              string   `json:"date"`
+	Issued            string   `json:"issued,omitempty"`
+	OrderingProvider  string   `json:"orderingProvider,omitempty"`
+	PlacerOrderNumber string   `json:"placerOrderNumber,omitempty"`
+	FillerOrderNumber string   `json:"fillerOrderNumber,omitempty"`
 }
 
 type Immunization struct {
-    Name   string `json:"name"`
-    System string `json:"system"`
-    Date   string `json:"date"`
+	Name   string `json:"name"`
+	System string `json:"system"`
+	Date   string `json:"date"`
+	// Status is the FHIR Immunization status taken from RXA-20/21
+	Codes        []Coding  `json:"codes,omitempty"`
+	DoseQuantity *Quantity `json:"doseQuantity,omitempty"`
+	Status       string    `json:"status,omitempty"`
 }